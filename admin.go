@@ -0,0 +1,129 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/greenpau/caddy-git/pkg/service"
+	"net/http"
+	"strings"
+)
+
+const (
+	deployKeysPath = "/git/deploy-keys/"
+	statusPath     = "/git/status/"
+)
+
+var (
+	// Interface guards
+	_ caddy.Module      = (*AdminAPI)(nil)
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI serves the public deploy keys and the status of the repositories
+// on the admin endpoint of Caddy.
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.git",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes returns the routes of the admin endpoint.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: deployKeysPath,
+			Handler: caddy.AdminHandlerFunc(a.handleDeployKeys),
+		},
+		{
+			Pattern: statusPath,
+			Handler: caddy.AdminHandlerFunc(a.handleStatus),
+		},
+	}
+}
+
+// handleStatus responds with the last recorded status of the repositories
+// in JSON, or with the status of a single repository, e.g.
+// /git/status/<name>.
+func (a *AdminAPI) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	statuses := service.Statuses()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, statusPath), "/")
+	if name == "" {
+		if statuses == nil {
+			statuses = []*service.Status{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(statuses)
+	}
+	for _, status := range statuses {
+		if status.Repository == name {
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(status)
+		}
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("status of repository %q not found", name),
+	}
+}
+
+// handleDeployKeys responds with the public deploy keys in JSON. The key
+// of a single repository, e.g. /git/deploy-keys/<name>, is returned in the
+// authorized keys format, so that it can be pasted into the deploy key
+// settings of the forge.
+func (a *AdminAPI) handleDeployKeys(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	keys := service.DeployKeys()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, deployKeysPath), "/")
+	if name == "" {
+		if keys == nil {
+			keys = []*service.DeployKey{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(keys)
+	}
+	for _, key := range keys {
+		if key.Repository == name {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, err := fmt.Fprintln(w, key.PublicKey)
+			return err
+		}
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("deploy key of repository %q not found", name),
+	}
+}
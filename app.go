@@ -60,6 +60,29 @@ func (app *App) Provision(ctx caddy.Context) error {
 		zap.String("app", app.Name),
 	)
 
+	if app.Config != nil {
+		app.Config.SetStorage(ctx.Storage())
+		// The secrets are kept as placeholders in the config until now.
+		repl := caddy.NewReplacer()
+		app.Config.ResolveSecrets(func(s string) string {
+			return repl.ReplaceKnown(s, "")
+		})
+		for _, rc := range app.Config.Repositories {
+			if rc.AuthProviderRaw == nil {
+				continue
+			}
+			mod, err := ctx.LoadModule(rc, "AuthProviderRaw")
+			if err != nil {
+				return fmt.Errorf("failed loading auth provider of %s repo: %v", rc.Name, err)
+			}
+			provider, ok := mod.(service.CredentialProvider)
+			if !ok {
+				return fmt.Errorf("auth provider of %s repo is not credential provider: %T", rc.Name, mod)
+			}
+			rc.SetAuthProvider(provider)
+		}
+	}
+
 	manager, err := service.NewManager(app.Config, app.logger)
 	if err != nil {
 		app.logger.Error(
@@ -0,0 +1,209 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/greenpau/caddy-git/pkg/service"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultAuthProviderTimeout = 30 * time.Second
+
+var (
+	// Interface guards
+	_ caddy.Module               = (*HTTPAuthProvider)(nil)
+	_ caddy.Provisioner          = (*HTTPAuthProvider)(nil)
+	_ caddyfile.Unmarshaler      = (*HTTPAuthProvider)(nil)
+	_ service.CredentialProvider = (*HTTPAuthProvider)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(HTTPAuthProvider{})
+}
+
+// HTTPAuthProvider requests the credentials of the repository from the
+// secrets endpoint before every fetch. The endpoint responds with the JSON
+// object with the username and password, or the token, for HTTP(S) remotes,
+// and with the private key and its passphrase for SSH remotes.
+type HTTPAuthProvider struct {
+	URL string `json:"url,omitempty"`
+	// The headers of the request, e.g. Authorization. The values are
+	// secrets, which should be set with the placeholders.
+	Headers map[string]service.Secret `json:"headers,omitempty"`
+	Timeout caddy.Duration            `json:"timeout,omitempty"`
+	client  *http.Client
+}
+
+// httpCredentials are the credentials in the response of the secrets
+// endpoint.
+type httpCredentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Token      string `json:"token"`
+	PrivateKey string `json:"private_key"`
+	Passphrase string `json:"passphrase"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (HTTPAuthProvider) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "git.auth.http",
+		New: func() caddy.Module { return new(HTTPAuthProvider) },
+	}
+}
+
+// Provision resolves the placeholders of the headers and sets up the client.
+func (p *HTTPAuthProvider) Provision(ctx caddy.Context) error {
+	if p.URL == "" {
+		return fmt.Errorf("auth provider url is empty")
+	}
+	if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("auth provider url %q is malformed", p.URL)
+	}
+	repl := caddy.NewReplacer()
+	for k, v := range p.Headers {
+		if v == service.RedactedSecret {
+			return fmt.Errorf("auth provider header %s is redacted, set it with a placeholder, e.g. {env.GIT_SECRET}", k)
+		}
+		p.Headers[k] = service.Secret(repl.ReplaceKnown(string(v), ""))
+	}
+	timeout := time.Duration(p.Timeout)
+	if timeout == 0 {
+		timeout = defaultAuthProviderTimeout
+	}
+	p.client = &http.Client{Timeout: timeout}
+	return nil
+}
+
+// MarshalJSONWithSecrets marshals the provider to JSON with the header
+// values kept as they are. The Caddyfile adapter uses it, because the adapted
+// JSON config is the only copy of the literal secrets of the Caddyfile.
+func (p *HTTPAuthProvider) MarshalJSONWithSecrets() ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil || len(p.Headers) == 0 {
+		return b, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string)
+	for k, v := range p.Headers {
+		headers[k] = string(v)
+	}
+	if fields["headers"], err = json.Marshal(headers); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// AuthMethod requests the credentials from the secrets endpoint and returns
+// the authentication for the transport of the repository.
+func (p *HTTPAuthProvider) AuthMethod(req *service.CredentialRequest) (transport.AuthMethod, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	for k, v := range p.Headers {
+		httpReq.Header.Set(k, string(v))
+	}
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed requesting credentials of %s: %v", req.Repository, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed requesting credentials of %s: %s", req.Repository, resp.Status)
+	}
+	creds := &httpCredentials{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(creds); err != nil {
+		return nil, fmt.Errorf("failed decoding credentials of %s: %v", req.Repository, err)
+	}
+
+	switch {
+	case req.IsHTTP():
+		switch {
+		case creds.Token != "" && creds.Username == "":
+			return &githttp.TokenAuth{Token: creds.Token}, nil
+		case creds.Token != "":
+			return &githttp.BasicAuth{Username: creds.Username, Password: creds.Token}, nil
+		case creds.Username != "":
+			return &githttp.BasicAuth{Username: creds.Username, Password: creds.Password}, nil
+		}
+	case req.IsSSH():
+		user := creds.Username
+		if user == "" {
+			user = "git"
+		}
+		switch {
+		case creds.PrivateKey != "":
+			return ssh.NewPublicKeys(user, []byte(creds.PrivateKey), creds.Passphrase)
+		case creds.Password != "":
+			return &ssh.Password{User: user, Password: creds.Password}, nil
+		}
+	}
+	return nil, fmt.Errorf("credentials of %s have no secrets for %s transport", req.Repository, req.Transport)
+}
+
+// UnmarshalCaddyfile sets up the provider from Caddyfile tokens.
+//
+// Syntax:
+//
+//	auth_provider http {
+//	  url <url>
+//	  header <name> <value>
+//	  timeout <duration>
+//	}
+func (p *HTTPAuthProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			k := d.Val()
+			args := d.RemainingArgs()
+			switch {
+			case k == "url" && len(args) == 1:
+				p.URL = args[0]
+			case k == "header" && len(args) == 2:
+				// The header values are secrets, e.g. the tokens.
+				if p.Headers == nil {
+					p.Headers = make(map[string]service.Secret)
+				}
+				p.Headers[args[0]] = parseSecret(d, k, args[1])
+			case k == "timeout" && len(args) == 1:
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil {
+					return d.Errf("timeout value %q is not duration", args[0])
+				}
+				p.Timeout = caddy.Duration(dur)
+			default:
+				return d.Errf("malformed %q directive: %v", k, args)
+			}
+		}
+	}
+	return nil
+}
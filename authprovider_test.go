@@ -0,0 +1,132 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/caddy-git/pkg/service"
+)
+
+func TestHTTPAuthProvider(t *testing.T) {
+	t.Setenv("TEST_SECRETS_AUTHORIZATION", "Bearer vault-token")
+
+	for _, tc := range []struct {
+		name      string
+		response  string
+		transport string
+		want      transport.AuthMethod
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:      "test token",
+			response:  `{"token": "secret-token"}`,
+			transport: "https",
+			want:      &githttp.TokenAuth{Token: "secret-token"},
+		},
+		{
+			name:      "test token with username",
+			response:  `{"username": "x-access-token", "token": "secret-token"}`,
+			transport: "https",
+			want:      &githttp.BasicAuth{Username: "x-access-token", Password: "secret-token"},
+		},
+		{
+			name:      "test username and password",
+			response:  `{"username": "foo", "password": "bar"}`,
+			transport: "http",
+			want:      &githttp.BasicAuth{Username: "foo", Password: "bar"},
+		},
+		{
+			name:      "test ssh password",
+			response:  `{"password": "bar"}`,
+			transport: "ssh",
+			want:      &ssh.Password{User: "git", Password: "bar"},
+		},
+		{
+			name:      "test token for ssh transport",
+			response:  `{"token": "secret-token"}`,
+			transport: "scp",
+			shouldErr: true,
+			err:       fmt.Errorf("credentials of foo have no secrets for scp transport"),
+		},
+		{
+			name:      "test malformed response",
+			response:  `foo`,
+			transport: "https",
+			shouldErr: true,
+			err:       fmt.Errorf("failed decoding credentials of foo: invalid character 'o' in literal false (expecting 'a')"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer vault-token" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write([]byte(tc.response))
+			}))
+			defer server.Close()
+
+			p := &HTTPAuthProvider{
+				URL:     server.URL,
+				Headers: map[string]service.Secret{"Authorization": "{env.TEST_SECRETS_AUTHORIZATION}"},
+			}
+			if err := p.Provision(caddy.Context{}); err != nil {
+				t.Fatalf("failed provisioning auth provider: %v", err)
+			}
+			got, err := p.AuthMethod(&service.CredentialRequest{
+				Repository: "foo",
+				URL:        "https://github.com/authp/authp.github.io.git",
+				Transport:  tc.transport,
+			})
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("unexpected auth method (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHTTPAuthProviderRedactedHeader(t *testing.T) {
+	p := &HTTPAuthProvider{
+		URL:     "https://secrets.example.com/git/authp",
+		Headers: map[string]service.Secret{"Authorization": service.RedactedSecret},
+	}
+	err := p.Provision(caddy.Context{})
+	want := "auth provider header Authorization is redacted, set it with a placeholder, e.g. {env.GIT_SECRET}"
+	if err == nil || err.Error() != want {
+		t.Fatalf("unexpected error: %v, want: %s", err, want)
+	}
+}
@@ -22,7 +22,9 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 	"github.com/greenpau/caddy-git/pkg/service"
+	"go.uber.org/zap"
 	"strconv"
 	"strings"
 )
@@ -39,13 +41,62 @@ func init() {
 // git {
 //   repo <name> {
 //     base_dir <path>
+//     git_dir <path>
 //     url <path>
-//     auth key <path> [passphrase <passphrase>] [no_strict_host_key_check]
-//     auth username <username> password <password>
+//     auth token|token_file <token|path> [username <username>]
+//     auth key <path>|auto [passphrase|passphrase_file <passphrase|path>] [certificate <path>] [<host_key_options>]
+//     auth key_data <pem> [passphrase|passphrase_file <passphrase|path>] [certificate <path>] [<host_key_options>]
+//     auth agent [<socket_path>] [<host_key_options>]
+//     auth github_app {
+//       app_id <id>
+//       installation_id <id>
+//       private_key_file <path>
+//       api_url <url>
+//     }
+//     auth username <username> password|password_file <password|path> [<host_key_options>]
+//       where <host_key_options> are any of:
+//         known_hosts <path>
+//         host_key <type> <base64>
+//         host_key_fingerprint SHA256:<base64>
+//         no_strict_host_key_check
+//     auth_provider <module> {
+//       <module_options>
+//     }
 //     webhook <name> <header> <secret>
 //     branch <name>
+//     branches <name> [<name>...]
 //     depth 1
+//     prune
+//     no_tags
+//     cache_size <size>
+//     large_object_threshold <size>
+//     mode checkout|mirror
+//     deploy checkout|export
+//     on_corrupt fail|quarantine|reclone
+//     symlinks allow|within_repo|deny
+//     commit_mtimes
+//     publish <repo_subdir> <dest_dir>
+//     preview {
+//       dir <path>
+//       host <pattern>
+//       ttl <duration>
+//     }
+//     lfs [<url>]
+//     tls {
+//       ca_file <path>
+//       client_cert <path>
+//       client_key <path>
+//       insecure_skip_verify
+//     }
+//     proxy <url>
+//     verify_signatures {
+//       gpg_key <path>
+//       allowed_signers <path>
+//       commits head|all
+//     }
 //     update every <seconds>
+//     maintenance every <duration>
+//     verify every <duration> [repair]
 //   }
 
 // parseCaddyfileHandlerConfig configures repo update handler.
@@ -55,18 +106,40 @@ func init() {
 // route /update {
 //   git update repo <name>
 // }
+//
+// route {
+//   git vars
+//   root * {git.repo.<name>.branch.<branch>.path}
+//   file_server
+// }
 
 const badRepl string = "ERROR_BAD_REPL"
 
 var argRules = map[string]argRule{
-	"base_dir": argRule{Min: 1, Max: 1},
-	"url":      argRule{Min: 1, Max: 1},
-	"auth":     argRule{Min: 2, Max: 255},
-	"branch":   argRule{Min: 1, Max: 1},
-	"depth":    argRule{Min: 1, Max: 1},
-	"update":   argRule{Min: 1, Max: 255},
-	"webhook":  argRule{Min: 3, Max: 3},
-	"post":     argRule{Min: 2, Max: 2},
+	"base_dir":               argRule{Min: 1, Max: 1},
+	"git_dir":                argRule{Min: 1, Max: 1},
+	"url":                    argRule{Min: 1, Max: 1},
+	"auth":                   argRule{Min: 1, Max: 255},
+	"auth_provider":          argRule{Min: 1, Max: 1},
+	"branch":                 argRule{Min: 1, Max: 1},
+	"depth":                  argRule{Min: 1, Max: 1},
+	"mode":                   argRule{Min: 1, Max: 1},
+	"deploy":                 argRule{Min: 1, Max: 1},
+	"on_corrupt":             argRule{Min: 1, Max: 1},
+	"symlinks":               argRule{Min: 1, Max: 1},
+	"commit_mtimes":          argRule{Min: 0, Max: 0},
+	"branches":               argRule{Min: 1, Max: 255},
+	"update":                 argRule{Min: 1, Max: 255},
+	"webhook":                argRule{Min: 3, Max: 3},
+	"post":                   argRule{Min: 2, Max: 2},
+	"publish":                argRule{Min: 2, Max: 2},
+	"lfs":                    argRule{Min: 0, Max: 1},
+	"prune":                  argRule{Min: 0, Max: 0},
+	"no_tags":                argRule{Min: 0, Max: 0},
+	"cache_size":             argRule{Min: 1, Max: 1},
+	"large_object_threshold": argRule{Min: 1, Max: 1},
+	"tls":                    argRule{Min: 0, Max: 0},
+	"proxy":                  argRule{Min: 1, Max: 1},
 }
 
 type argRule struct {
@@ -94,7 +167,10 @@ func parseCaddyfileAppConfig(d *caddyfile.Dispenser, _ interface{}) (interface{}
 			rc.Name = args[0]
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
 				k := d.Val()
-				v := findReplace(repl, d.RemainingArgs())
+				// The secrets are parsed from the arguments with the
+				// placeholders, which are resolved when provisioned.
+				args := d.RemainingArgs()
+				v := findReplace(repl, args)
 				if _, exists := argRules[k]; exists {
 					if err := validateArg(k, v); err != nil {
 						return nil, d.Errf("%s", err)
@@ -103,19 +179,36 @@ func parseCaddyfileAppConfig(d *caddyfile.Dispenser, _ interface{}) (interface{}
 				switch k {
 				case "base_dir":
 					rc.BaseDir = v[0]
+				case "git_dir":
+					rc.GitDir = v[0]
 				case "url":
 					rc.Address = v[0]
 				case "auth":
 					authCfg := &service.AuthConfig{}
+					// The options follow the credentials.
+					var opts []string
 					switch v[0] {
-					case "key":
+					case "key", "key_data":
 						if len(v) < 2 {
 							return nil, d.Errf("malformed %q directive: %v", k, v)
 						}
-						authCfg.KeyPath = v[1]
-						if len(v) > 2 {
-							if v[2] == "passphrase" {
-								authCfg.KeyPassphrase = v[3]
+						switch {
+						case v[0] == "key" && v[1] == "auto":
+							authCfg.KeyAuto = true
+						case v[0] == "key":
+							authCfg.KeyPath = v[1]
+						default:
+							authCfg.KeyData = parseSecret(d, "key_data", args[1])
+						}
+						opts = v[2:]
+						if len(v) > 3 {
+							switch v[2] {
+							case "passphrase":
+								authCfg.KeyPassphrase = parseSecret(d, "passphrase", args[3])
+								opts = v[4:]
+							case "passphrase_file":
+								authCfg.KeyPassphraseFile = v[3]
+								opts = v[4:]
 							}
 						}
 					case "username":
@@ -123,30 +216,140 @@ func parseCaddyfileAppConfig(d *caddyfile.Dispenser, _ interface{}) (interface{}
 							return nil, d.Errf("malformed %q directive", k)
 						}
 						authCfg.Username = v[1]
-						if v[2] == "password" {
-							authCfg.Password = v[3]
+						switch v[2] {
+						case "password":
+							authCfg.Password = parseSecret(d, "password", args[3])
+						case "password_file":
+							authCfg.PasswordFile = v[3]
+						}
+						opts = v[4:]
+					case "token", "token_file":
+						if len(v) < 2 {
+							return nil, d.Errf("malformed %q directive: %v", k, v)
+						}
+						if v[0] == "token" {
+							authCfg.Token = parseSecret(d, "token", args[1])
+						} else {
+							authCfg.TokenFile = v[1]
+						}
+						opts = v[2:]
+						if len(opts) > 1 && opts[0] == "username" {
+							authCfg.Username = opts[1]
+							opts = opts[2:]
+						}
+					case "github_app":
+						if len(v) > 1 {
+							return nil, d.Errf("malformed %q directive: %v", k, v)
 						}
+						appCfg := &service.GitHubAppConfig{}
+						for nesting := d.Nesting(); d.NextBlock(nesting); {
+							nk := d.Val()
+							nargs := findReplace(repl, d.RemainingArgs())
+							if len(nargs) != 1 {
+								return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+							}
+							switch nk {
+							case "app_id":
+								appCfg.AppID = nargs[0]
+							case "installation_id":
+								n, err := strconv.ParseInt(nargs[0], 10, 64)
+								if err != nil {
+									return nil, d.Errf("%s value %q is not integer", nk, nargs[0])
+								}
+								appCfg.InstallationID = n
+							case "private_key_file":
+								appCfg.PrivateKeyFile = nargs[0]
+							case "api_url":
+								appCfg.APIURL = nargs[0]
+							default:
+								return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+							}
+						}
+						authCfg.GitHubApp = appCfg
+					case "agent":
+						authCfg.Agent = true
+						opts = v[1:]
+						// The socket path is optional.
+						if len(opts) > 0 {
+							switch opts[0] {
+							case "no_strict_host_key_check", "known_hosts", "host_key", "host_key_fingerprint", "certificate":
+							default:
+								authCfg.AgentSocket = opts[0]
+								opts = opts[1:]
+							}
+						}
+					default:
+						opts = v
 					}
-					if findString(v, "no_strict_host_key_check") {
-						authCfg.StrictHostKeyCheckingDisabled = true
+					for len(opts) > 0 {
+						opt := opts[0]
+						switch {
+						case opt == "no_strict_host_key_check":
+							authCfg.StrictHostKeyCheckingDisabled = true
+							opts = opts[1:]
+						case opt == "certificate" && len(opts) > 1:
+							authCfg.Certificate = opts[1]
+							opts = opts[2:]
+						case opt == "known_hosts" && len(opts) > 1:
+							authCfg.KnownHosts = opts[1]
+							opts = opts[2:]
+						case opt == "host_key" && len(opts) > 2:
+							authCfg.HostKeys = append(authCfg.HostKeys, opts[1]+" "+opts[2])
+							opts = opts[3:]
+						case opt == "host_key_fingerprint" && len(opts) > 1:
+							authCfg.HostKeyFingerprints = append(authCfg.HostKeyFingerprints, opts[1])
+							opts = opts[2:]
+						default:
+							return nil, d.Errf("malformed %q directive: %v", k, v)
+						}
 					}
 					rc.Auth = authCfg
 				case "webhook":
 					whCfg := &service.WebhookConfig{
 						Name:   v[0],
 						Header: v[1],
-						Secret: v[2],
+						Secret: parseSecret(d, "webhook", args[2]),
 					}
 					rc.Webhooks = append(rc.Webhooks, whCfg)
 				case "branch":
 					rc.Branch = v[0]
+				case "branches":
+					rc.Branches = v
+				case "mode":
+					rc.Mode = v[0]
+				case "deploy":
+					rc.Deploy = v[0]
+				case "on_corrupt":
+					rc.OnCorrupt = v[0]
+				case "symlinks":
+					rc.Symlinks = v[0]
+				case "commit_mtimes":
+					rc.CommitMtimes = true
+				case "publish":
+					rc.Publish = append(rc.Publish, &service.PublishConfig{
+						Source:      v[0],
+						Destination: v[1],
+					})
 				case "depth":
 					if n, err := strconv.Atoi(v[0]); err == nil {
 						rc.Depth = n
 					} else {
 						return nil, d.Errf("%s value %q is not integer", k, v[0])
 					}
-					// return nil, d.Errf("the depth directive is disabled due to the issue with github.com/go-git/go-git")
+				case "prune":
+					rc.Prune = true
+				case "no_tags":
+					rc.NoTags = true
+				case "cache_size", "large_object_threshold":
+					n, err := humanize.ParseBytes(v[0])
+					if err != nil {
+						return nil, d.Errf("%s value %q is not size", k, v[0])
+					}
+					if k == "cache_size" {
+						rc.CacheSize = int64(n)
+					} else {
+						rc.LargeObjectThreshold = int64(n)
+					}
 				case "post":
 					switch {
 					case strings.Join(v, " ") == "pull exec":
@@ -169,6 +372,92 @@ func parseCaddyfileAppConfig(d *caddyfile.Dispenser, _ interface{}) (interface{}
 					default:
 						return nil, d.Errf("malformed %q directive: %v", k, v)
 					}
+				case "preview":
+					if len(v) > 0 {
+						return nil, d.Errf("malformed %q directive: %v", k, v)
+					}
+					pvCfg := &service.PreviewConfig{}
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						nk := d.Val()
+						nargs := findReplace(repl, d.RemainingArgs())
+						if len(nargs) != 1 {
+							return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+						}
+						switch nk {
+						case "dir":
+							pvCfg.Dir = nargs[0]
+						case "host":
+							pvCfg.Host = nargs[0]
+						case "ttl":
+							n, err := parseSeconds(nargs[0])
+							if err != nil {
+								return nil, d.Errf("%s value %q is not duration", nk, nargs[0])
+							}
+							pvCfg.TTL = n
+						default:
+							return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+						}
+					}
+					rc.Preview = pvCfg
+				case "lfs":
+					rc.LFS = &service.LFSConfig{}
+					if len(v) > 0 {
+						rc.LFS.URL = v[0]
+					}
+				case "tls":
+					tlsCfg := &service.TLSConfig{}
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						nk := d.Val()
+						nargs := findReplace(repl, d.RemainingArgs())
+						switch {
+						case nk == "ca_file" && len(nargs) == 1:
+							tlsCfg.CAFile = nargs[0]
+						case nk == "client_cert" && len(nargs) == 1:
+							tlsCfg.ClientCert = nargs[0]
+						case nk == "client_key" && len(nargs) == 1:
+							tlsCfg.ClientKey = nargs[0]
+						case nk == "insecure_skip_verify" && len(nargs) == 0:
+							tlsCfg.InsecureSkipVerify = true
+						default:
+							return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+						}
+					}
+					rc.TLS = tlsCfg
+				case "auth_provider":
+					// The provider module parses its own block.
+					unm, err := caddyfile.UnmarshalModule(d, "git.auth."+v[0])
+					if err != nil {
+						return nil, err
+					}
+					rc.AuthProviderRaw, err = marshalAuthProvider(unm, v[0])
+					if err != nil {
+						return nil, err
+					}
+				case "proxy":
+					rc.Proxy = v[0]
+				case "verify_signatures":
+					if len(v) > 0 {
+						return nil, d.Errf("malformed %q directive: %v", k, v)
+					}
+					sigCfg := &service.SignatureConfig{}
+					for nesting := d.Nesting(); d.NextBlock(nesting); {
+						nk := d.Val()
+						nargs := findReplace(repl, d.RemainingArgs())
+						if len(nargs) != 1 {
+							return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+						}
+						switch nk {
+						case "gpg_key":
+							sigCfg.GPGKeys = append(sigCfg.GPGKeys, nargs[0])
+						case "allowed_signers":
+							sigCfg.AllowedSigners = nargs[0]
+						case "commits":
+							sigCfg.Commits = nargs[0]
+						default:
+							return nil, d.Errf("malformed %q directive: %v", nk, nargs)
+						}
+					}
+					rc.VerifySignatures = sigCfg
 				case "update":
 					if len(v) != 2 {
 						return nil, d.Errf("malformed %q directive: %v", k, v)
@@ -181,6 +470,25 @@ func parseCaddyfileAppConfig(d *caddyfile.Dispenser, _ interface{}) (interface{}
 					} else {
 						return nil, d.Errf("%s value %q is not integer", k, v[0])
 					}
+				case "maintenance":
+					if len(v) != 2 || v[0] != "every" {
+						return nil, d.Errf("malformed %q directive: %v", k, v)
+					}
+					n, err := parseSeconds(v[1])
+					if err != nil {
+						return nil, d.Errf("%s value %q is not duration", k, v[1])
+					}
+					rc.MaintenanceInterval = n
+				case "verify":
+					if len(v) < 2 || len(v) > 3 || v[0] != "every" || (len(v) == 3 && v[2] != "repair") {
+						return nil, d.Errf("malformed %q directive: %v", k, v)
+					}
+					n, err := parseSeconds(v[1])
+					if err != nil {
+						return nil, d.Errf("%s value %q is not duration", k, v[1])
+					}
+					rc.VerifyInterval = n
+					rc.VerifyRepair = len(v) == 3
 				default:
 					return nil, d.Errf("unsupported %q key", k)
 				}
@@ -193,9 +501,14 @@ func parseCaddyfileAppConfig(d *caddyfile.Dispenser, _ interface{}) (interface{}
 		}
 	}
 
+	// The literal secrets are not redacted, so that Caddy receives them.
+	cfg, err := app.Config.MarshalJSONWithSecrets()
+	if err != nil {
+		return nil, err
+	}
 	return httpcaddyfile.App{
 		Name:  appName,
-		Value: caddyconfig.JSON(app, nil),
+		Value: caddyconfig.JSON(map[string]json.RawMessage{"config": cfg}, nil),
 	}, nil
 }
 
@@ -219,6 +532,16 @@ func parseCaddyfileHandlerConfig(h httpcaddyfile.Helper) (*service.Endpoint, err
 	for h.Next() {
 		args := h.RemainingArgs()
 		strArgs := strings.Join(args, " ")
+		switch {
+		case strArgs == service.ActionVars:
+			endpoint.Path = "*"
+			endpoint.Action = service.ActionVars
+			continue
+		case len(args) == 2 && args[1] == service.ActionVars:
+			endpoint.Path = args[0]
+			endpoint.Action = service.ActionVars
+			continue
+		}
 		if !strings.Contains(strArgs, "update repo ") {
 			return nil, h.Errf("unsupported config: git %s", strArgs)
 		}
@@ -271,11 +594,52 @@ func findReplace(repl *caddy.Replacer, arr []string) (output []string) {
 	return output
 }
 
-func findString(arr []string, s string) bool {
-	for _, x := range arr {
-		if x == s {
-			return true
-		}
+// parseSecret parses the secret of the directive. The literal secrets are
+// deprecated in favor of placeholders, e.g. {env.GIT_PASSWORD}, because they
+// are kept in JSON config, which the Caddyfile is adapted to.
+func parseSecret(d *caddyfile.Dispenser, k, s string) service.Secret {
+	secret := service.Secret(s)
+	if !secret.IsPlaceholder() {
+		caddy.Log().Named(appName).Warn(
+			"literal secret is deprecated, use a placeholder, e.g. {env.GIT_SECRET}",
+			zap.String("directive", k),
+			zap.String("file", d.File()),
+			zap.Int("line", d.Line()),
+		)
+	}
+	return secret
+}
+
+// marshalAuthProvider marshals the credential provider module to JSON with
+// the module name. The literal secrets of the providers implementing
+// MarshalJSONWithSecrets are kept in the JSON config.
+func marshalAuthProvider(unm caddyfile.Unmarshaler, name string) (json.RawMessage, error) {
+	m, ok := unm.(interface{ MarshalJSONWithSecrets() ([]byte, error) })
+	if !ok {
+		return caddyconfig.JSONModuleObject(unm, "provider", name, nil), nil
+	}
+	b, err := m.MarshalJSONWithSecrets()
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	if fields["provider"], err = json.Marshal(name); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// parseSeconds parses the number of seconds or a duration, e.g. 72h or 3d.
+func parseSeconds(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	dur, err := caddy.ParseDuration(s)
+	if err != nil {
+		return 0, err
 	}
-	return false
+	return int(dur.Seconds()), nil
 }
@@ -16,9 +16,43 @@ package errors
 
 // Config-related errors.
 const (
-	ErrRepositoryConfigNil                StandardError = "repository config is nil"
-	ErrRepositoryConfigNameEmpty          StandardError = "repository config name is empty"
-	ErrRepositoryConfigExists             StandardError = "repository config %q name already exists"
-	ErrRepositoryConfigAddressEmpty       StandardError = "repository config address is empty"
-	ErrRepositoryConfigAddressUnsupported StandardError = "repository config address %q is unsupported"
+	ErrRepositoryConfigNil                    StandardError = "repository config is nil"
+	ErrRepositoryConfigNameEmpty              StandardError = "repository config name is empty"
+	ErrRepositoryConfigExists                 StandardError = "repository config %q name already exists"
+	ErrRepositoryConfigAddressEmpty           StandardError = "repository config address is empty"
+	ErrRepositoryConfigAddressUnsupported     StandardError = "repository config address %q is unsupported"
+	ErrRepositoryConfigAddressMalformed       StandardError = "repository config address %q is malformed: %v"
+	ErrRepositoryConfigAuthUnsupported        StandardError = "repository config auth is unsupported for %s transport"
+	ErrRepositoryConfigAuthTypeMismatch       StandardError = "repository config %s auth is unsupported for %s transport"
+	ErrRepositoryConfigHostKeyConflict        StandardError = "repository config host key pinning conflicts with no_strict_host_key_check"
+	ErrRepositoryConfigHostKeyCredentialless  StandardError = "repository config host key pinning requires key, agent or username"
+	ErrRepositoryConfigAuthTokenConflict      StandardError = "repository config auth token conflicts with password"
+	ErrRepositoryConfigAuthSecretConflict     StandardError = "repository config auth %s conflicts with %s"
+	ErrRepositoryConfigAuthCertificateKeyless StandardError = "repository config auth certificate requires key"
+	ErrRepositoryConfigGitHubAppIncomplete    StandardError = "repository config auth github_app requires %s"
+	ErrRepositoryConfigGitHubAppURLMalformed  StandardError = "repository config auth github_app api_url %q is malformed"
+	ErrRepositoryConfigHTTPOptionUnsupported  StandardError = "repository config %s is unsupported for %s transport"
+	ErrRepositoryConfigTLSClientIncomplete    StandardError = "repository config tls client_cert requires client_key"
+	ErrRepositoryConfigProxyMalformed         StandardError = "repository config proxy %q is malformed"
+	ErrRepositoryConfigAuthProviderConflict   StandardError = "repository config auth conflicts with auth_provider"
+	ErrRepositoryConfigSecretRedacted         StandardError = "repository config %s secret is redacted, set it with a placeholder, e.g. {env.GIT_SECRET}"
+	ErrRepositoryConfigHostKeyMalformed       StandardError = "repository config host key %q is malformed"
+	ErrRepositoryConfigModeUnsupported        StandardError = "repository config mode %q is unsupported"
+	ErrRepositoryConfigModeConflict           StandardError = "repository config %s is unsupported in %s mode"
+	ErrRepositoryConfigDeployUnsupported      StandardError = "repository config deploy %q is unsupported"
+	ErrRepositoryConfigDeployConflict         StandardError = "repository config %s is unsupported with %s deploy"
+	ErrRepositoryConfigOnCorruptUnsupported   StandardError = "repository config on_corrupt %q is unsupported"
+	ErrRepositoryConfigSymlinksUnsupported    StandardError = "repository config symlinks %q is unsupported"
+	ErrRepositoryConfigPublishMalformed       StandardError = "repository config publish %q to %q is malformed"
+	ErrRepositoryConfigPublishOverlap         StandardError = "repository config publish destination %q overlaps %q"
+	ErrRepositoryConfigBranchMalformed        StandardError = "repository config branch %q is malformed"
+	ErrRepositoryConfigBranchesCollision      StandardError = "repository config branches %q and %q are deployed to the same directory"
+	ErrRepositoryConfigBranchesConflict       StandardError = "repository config %s is unsupported with branches"
+	ErrRepositoryConfigBranchPreviewsOverlap  StandardError = "repository config branch %q is deployed to the previews directory"
+	ErrRepositoryConfigPreviewWebhookRequired StandardError = "repository config preview requires webhook"
+	ErrRepositoryConfigPreviewHostMalformed   StandardError = "repository config preview host %q must have a single wildcard"
+	ErrRepositoryConfigSignersEmpty           StandardError = "repository config verify_signatures has no trusted keys"
+	ErrRepositoryConfigSignersCommits         StandardError = "repository config verify_signatures commits %q is unsupported"
+	ErrRepositoryConfigSignersDepth           StandardError = "repository config verify_signatures commits all is unsupported with depth"
+	ErrRepositoryConfigLFSURLRequired         StandardError = "repository config lfs url is required for %s transport"
 )
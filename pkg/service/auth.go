@@ -0,0 +1,159 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// loadSecrets returns the copy of the config with the secrets loaded.
+func (ac *AuthConfig) loadSecrets(client *http.Client) (*AuthConfig, error) {
+	loaded := *ac
+	for _, secret := range []struct {
+		fp  string
+		dst *Secret
+	}{
+		{ac.PasswordFile, &loaded.Password},
+		{ac.TokenFile, &loaded.Token},
+		{ac.KeyPassphraseFile, &loaded.KeyPassphrase},
+	} {
+		if secret.fp == "" {
+			continue
+		}
+		// The secret files, the keys and the certificates are read on every
+		// use, so that the rotated ones are used without reloading Caddy.
+		b, err := os.ReadFile(expandDir(secret.fp))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading secret file: %v", err)
+		}
+		*secret.dst = Secret(strings.TrimSpace(string(b)))
+	}
+	if ac.GitHubApp != nil {
+		token, err := ac.GitHubApp.installationToken(client)
+		if err != nil {
+			return nil, err
+		}
+		loaded.Username = githubAppUsername
+		loaded.Token = Secret(token)
+	}
+	return &loaded, nil
+}
+
+// sshAgent is the client of SSH agent kept by the repository, so that its
+// updates share a single connection to the agent.
+type sshAgent struct {
+	mu     sync.Mutex
+	socket string
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// connect connects to the agent, unless the connection is already open.
+func (a *sshAgent) connect() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		return nil
+	}
+	conn, err := net.Dial("unix", a.socket)
+	if err != nil {
+		return fmt.Errorf("failed connecting to ssh agent: %v", err)
+	}
+	a.conn = conn
+	a.client = agent.NewClient(conn)
+	return nil
+}
+
+// signers returns the signers of the keys held by the agent. The connection
+// is reopened once, when the agent was restarted since the last use.
+func (a *sshAgent) signers() ([]cryptossh.Signer, error) {
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	signers, err := a.client.Signers()
+	a.mu.Unlock()
+	if err == nil {
+		return signers, nil
+	}
+	a.close()
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client.Signers()
+}
+
+// close closes the connection to the agent.
+func (a *sshAgent) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+		a.client = nil
+	}
+}
+
+// newAgentAuth returns the authentication with the keys of SSH agent. The
+// agent listens on the socket, or on SSH_AUTH_SOCK when the socket is empty.
+// The connection to the agent is kept open for the next updates.
+func (rc *RepositoryConfig) newAgentAuth(user, socket string) (*ssh.PublicKeysCallback, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("ssh agent socket is not set, SSH_AUTH_SOCK is empty")
+	}
+	socket = expandDir(socket)
+
+	rc.agentMu.Lock()
+	if rc.agent != nil && rc.agent.socket != socket {
+		rc.agent.close()
+		rc.agent = nil
+	}
+	if rc.agent == nil {
+		rc.agent = &sshAgent{socket: socket}
+	}
+	a := rc.agent
+	rc.agentMu.Unlock()
+
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+	return &ssh.PublicKeysCallback{
+		User:     user,
+		Callback: a.signers,
+	}, nil
+}
+
+// closeAgent closes the connection to SSH agent, when it is open.
+func (rc *RepositoryConfig) closeAgent() {
+	rc.agentMu.Lock()
+	defer rc.agentMu.Unlock()
+	if rc.agent != nil {
+		rc.agent.close()
+		rc.agent = nil
+	}
+}
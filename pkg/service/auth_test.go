@@ -0,0 +1,346 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newTestGitHandler serves the repositories in the directory with git
+// http-backend. The requests are served only when authorized.
+func newTestGitHandler(t *testing.T, rootDir string, authorized func(r *http.Request) bool) http.Handler {
+	t.Helper()
+	out, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git is not available")
+	}
+	backend := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(out)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + rootDir, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	})
+}
+
+// newTestHTTPServer serves the repositories in the directory over HTTP.
+func newTestHTTPServer(t *testing.T, rootDir string, authorized func(r *http.Request) bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(newTestGitHandler(t, rootDir, authorized))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRepositoryUpdateHTTPAuth(t *testing.T) {
+	authorized := func(r *http.Request) bool {
+		if r.Header.Get("Authorization") == "Bearer secret-token" {
+			return true
+		}
+		username, password, ok := r.BasicAuth()
+		switch {
+		case !ok:
+			return false
+		case username == "foo" && password == "bar":
+			return true
+		case username == "x-access-token" && password == "secret-token":
+			return true
+		}
+		return false
+	}
+
+	for _, tc := range []struct {
+		name      string
+		auth      *AuthConfig
+		shouldErr bool
+	}{
+		{
+			name: "test basic auth",
+			auth: &AuthConfig{Username: "foo", Password: "bar"},
+		},
+		{
+			name: "test bearer token",
+			auth: &AuthConfig{Token: "secret-token"},
+		},
+		{
+			name: "test token with username",
+			auth: &AuthConfig{Username: "x-access-token", Token: "secret-token"},
+		},
+		{
+			name:      "test invalid token",
+			auth:      &AuthConfig{Token: "other-token"},
+			shouldErr: true,
+		},
+		{
+			name:      "test without auth",
+			shouldErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+			server := newTestHTTPServer(t, filepath.Dir(upstream.bareDir), authorized)
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: server.URL + "/" + filepath.Base(upstream.bareDir),
+				Auth:    tc.auth,
+			})
+			err := r.update()
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected authentication error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+			if diff := cmp.Diff("v1", got); diff != "" {
+				t.Fatalf("unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdateSecretFiles(t *testing.T) {
+	var token atomic.Value
+	token.Store("token-v1")
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	server := newTestHTTPServer(t, filepath.Dir(upstream.bareDir), func(r *http.Request) bool {
+		_, password, ok := r.BasicAuth()
+		return ok && password == token.Load().(string)
+	})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeToken := func(s string) {
+		if err := os.WriteFile(tokenFile, []byte(s+"\n"), 0600); err != nil {
+			t.Fatalf("failed writing token file: %v", err)
+		}
+	}
+	writeToken("token-v1")
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: server.URL + "/" + filepath.Base(upstream.bareDir),
+		Auth:    &AuthConfig{Username: "x-access-token", TokenFile: tokenFile},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+
+	// The token is rotated by the server before the file is updated.
+	token.Store("token-v2")
+	upstream.commit("update", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected authentication error with stale token")
+	}
+	writeToken("token-v2")
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo with rotated token: %v", err)
+	}
+	got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+	if diff := cmp.Diff("v2", got); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+	if r.Config.Auth.Token != "" {
+		t.Fatalf("expected token kept out of config, got: %q", r.Config.Auth.Token)
+	}
+}
+
+// newTestAgent serves SSH agent holding the keys on the unix socket.
+func newTestAgent(t *testing.T, keys ...interface{}) string {
+	t.Helper()
+	socket, _ := newCountingTestAgent(t, keys...)
+	return socket
+}
+
+// newCountingTestAgent serves SSH agent holding the keys on the unix socket
+// and counts the accepted connections.
+func newCountingTestAgent(t *testing.T, keys ...interface{}) (string, *atomic.Int32) {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatalf("failed adding key to agent: %v", err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	conns := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket, conns
+}
+
+func TestRepositoryUpdateSSHKeys(t *testing.T) {
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientSigner, _ := cryptossh.NewSignerFromKey(clientKey)
+	server := newTestSSHServer(t, &cryptossh.ServerConfig{
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	})
+	der, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("failed marshaling private key: %v", err)
+	}
+	keyData := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	for _, tc := range []struct {
+		name      string
+		auth      func(t *testing.T) *AuthConfig
+		shouldErr bool
+	}{
+		{
+			name: "test key data",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{KeyData: Secret(keyData)}
+			},
+		},
+		{
+			name: "test agent socket",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{Agent: true, AgentSocket: newTestAgent(t, clientKey)}
+			},
+		},
+		{
+			name: "test agent from environment",
+			auth: func(t *testing.T) *AuthConfig {
+				t.Setenv("SSH_AUTH_SOCK", newTestAgent(t, otherKey, clientKey))
+				return &AuthConfig{Agent: true}
+			},
+		},
+		{
+			name: "test agent without key",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{Agent: true, AgentSocket: newTestAgent(t, otherKey)}
+			},
+			shouldErr: true,
+		},
+		{
+			name: "test agent without socket",
+			auth: func(t *testing.T) *AuthConfig {
+				t.Setenv("SSH_AUTH_SOCK", "")
+				return &AuthConfig{Agent: true}
+			},
+			shouldErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+			auth := tc.auth(t)
+			auth.HostKeys = []string{string(cryptossh.MarshalAuthorizedKey(server.hostKeys[1].PublicKey()))}
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: server.url(upstream.bareDir),
+				Auth:    auth,
+			})
+			err := r.update()
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected authentication error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+			if diff := cmp.Diff("v1", got); diff != "" {
+				t.Fatalf("unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdateSSHAgentConnection(t *testing.T) {
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientSigner, _ := cryptossh.NewSignerFromKey(clientKey)
+	server := newTestSSHServer(t, &cryptossh.ServerConfig{
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	})
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	socket, conns := newCountingTestAgent(t, clientKey)
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: server.url(upstream.bareDir),
+		Auth: &AuthConfig{
+			Agent:       true,
+			AgentSocket: socket,
+			HostKeys:    []string{string(cryptossh.MarshalAuthorizedKey(server.hostKeys[1].PublicKey()))},
+		},
+	})
+	for i := 0; i < 3; i++ {
+		if err := r.update(); err != nil {
+			t.Fatalf("failed updating repo: %v", err)
+		}
+	}
+	if diff := cmp.Diff(int32(1), conns.Load()); diff != "" {
+		t.Fatalf("unexpected number of agent connections (-want +got):\n%s", diff)
+	}
+	r.stop()
+	if r.Config.agent != nil {
+		t.Fatalf("expected agent connection closed on stop")
+	}
+}
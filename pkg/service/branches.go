@@ -0,0 +1,194 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runBranchesUpdate fetches the configured branches into a single private
+// bare repository and writes the tree of each branch into its own directory
+// under repoDir. The branches share the object store of the repository.
+func (r *Repository) runBranchesUpdate(repoDir string) error {
+	repo, err := r.fetchBranches(r.exportGitDir(repoDir))
+	if err != nil {
+		return err
+	}
+
+	for _, branch := range r.Config.Branches {
+		ref, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch), true)
+		if err != nil {
+			return err
+		}
+		// The local branch tracks the deployed commit.
+		branchRef := plumbing.NewBranchReferenceName(branch)
+		var deployed plumbing.Hash
+		if localRef, err := repo.Reference(branchRef, true); err == nil {
+			deployed = localRef.Hash()
+		}
+		commit, err := r.updateBranch(repo, branchRef, ref.Hash())
+		if err != nil {
+			return err
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return err
+		}
+		branchDir := r.branchDir(branch)
+		if err := exportTree(tree, "", branchDir, r.newLFSStore()); err != nil {
+			return err
+		}
+		if r.Config.CommitMtimes && deployed != commit.Hash {
+			if err := r.applyCommitTimes(repo, deployed, commit, "", branchDir); err != nil {
+				return err
+			}
+		}
+		r.logger.Debug(
+			"deployed branch",
+			zap.String("repo_name", r.Config.Name),
+			zap.String("branch", branch),
+			zap.String("path", branchDir),
+			zap.String("commit", commit.Hash.String()),
+		)
+	}
+	return r.removeStaleBranches(repo, repoDir)
+}
+
+// removeStaleBranches removes the directories and the local branches of the
+// branches, which are no longer configured. The previews are kept.
+func (r *Repository) removeStaleBranches(repo *git.Repository, repoDir string) error {
+	configured := make(map[string]bool)
+	deployed := make(map[string]bool)
+	for _, branch := range r.Config.Branches {
+		configured[branch] = true
+		deployed[branchDirName(branch)] = true
+	}
+
+	entries, err := os.ReadDir(repoDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(repoDir, entry.Name())
+		if !entry.IsDir() || deployed[entry.Name()] {
+			continue
+		}
+		if r.Config.Preview != nil && pathsOverlap(dir, r.previewsDir()) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		r.logger.Debug(
+			"removed branch directory",
+			zap.String("repo_name", r.Config.Name),
+			zap.String("path", dir),
+		)
+	}
+
+	refs, err := repo.Branches()
+	if err != nil {
+		return err
+	}
+	var stale []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if !configured[ref.Name().Short()] {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		for _, ref := range []plumbing.ReferenceName{name, plumbing.NewRemoteReferenceName(git.DefaultRemoteName, name.Short())} {
+			if err := repo.Storer.RemoveReference(ref); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchBranches fetches the configured branches into a bare repository in
+// gitDir. The repository is initialized when it does not exist.
+func (r *Repository) fetchBranches(gitDir string) (*git.Repository, error) {
+	gitDirExists, err := dirExists(gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var repo *git.Repository
+	if gitDirExists {
+		repo, err = r.openBare(gitDir)
+	} else {
+		repo, err = r.initBare(gitDir)
+		if err == nil {
+			_, err = repo.CreateRemote(&config.RemoteConfig{
+				Name: git.DefaultRemoteName,
+				URLs: []string{r.Config.cloneURL()},
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &git.FetchOptions{}
+	if err := configureFetchOptions(r.Config, opts); err != nil {
+		return nil, err
+	}
+	for _, branch := range r.Config.Branches {
+		opts.RefSpecs = append(opts.RefSpecs, config.RefSpec(
+			"+"+plumbing.NewBranchReferenceName(branch).String()+":"+
+				plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch).String(),
+		))
+	}
+	opts.Tags = git.NoTags
+	if err := repo.Fetch(opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// branchDir returns the directory where the branch is being deployed.
+func (r *Repository) branchDir(branch string) string {
+	return filepath.Join(r.Config.BaseDir, r.Config.Name, branchDirName(branch))
+}
+
+// branchDirName returns the name of the directory of the branch.
+func branchDirName(branch string) string {
+	return strings.ReplaceAll(branch, "/", "-")
+}
+
+// isValidBranchName checks whether the branch name is safe to use as the
+// directory name, i.e. it has no empty, hidden, or parent components.
+func isValidBranchName(branch string) bool {
+	if branch == "" || strings.Contains(branch, "..") || strings.Contains(branch, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(branch, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
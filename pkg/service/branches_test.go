@@ -0,0 +1,162 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepositoryUpdateBranches(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("main")})
+	upstream.branch("staging")
+	upstream.branch("docs/next")
+	upstream.commit("main commit", map[string][]byte{"index.html": []byte("main v2")})
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address:  upstream.bareDir,
+		Branches: []string{"master", "staging", "docs/next"},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo: %v", err)
+	}
+
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	for branch, want := range map[string]string{
+		"master":    "main v2",
+		"staging":   "main",
+		"docs-next": "main",
+	} {
+		got := readTestFile(t, filepath.Join(repoDir, branch, "index.html"))
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected content of %s branch (-want +got):\n%s", branch, diff)
+		}
+	}
+
+	manager = &Manager{repos: map[string]*Repository{r.Config.Name: r}}
+	defer func() {
+		manager = nil
+	}()
+	endpoint := &Endpoint{Action: ActionVars}
+	got := endpoint.Placeholders(httptest.NewRequest("GET", "/", nil))
+	want := map[string]string{
+		"git.repo.test.path":                  repoDir,
+		"git.repo.test.branch.master.path":    filepath.Join(repoDir, "master"),
+		"git.repo.test.branch.staging.path":   filepath.Join(repoDir, "staging"),
+		"git.repo.test.branch.docs/next.path": filepath.Join(repoDir, "docs-next"),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected placeholders (-want +got):\n%s", diff)
+	}
+
+	// The branch removed from the config is removed with its directory.
+	r.Config.Branches = []string{"master", "docs/next"}
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo: %v", err)
+	}
+	entries, err := os.ReadDir(repoDir)
+	if err != nil {
+		t.Fatalf("failed reading %s: %v", repoDir, err)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		dirs = append(dirs, entry.Name())
+	}
+	if diff := cmp.Diff([]string{"docs-next", "master"}, dirs); diff != "" {
+		t.Fatalf("unexpected branch directories (-want +got):\n%s", diff)
+	}
+	repo, err := r.openBare(r.exportGitDir(repoDir))
+	if err != nil {
+		t.Fatalf("failed opening repo: %v", err)
+	}
+	for _, name := range []plumbing.ReferenceName{"refs/heads/staging", "refs/remotes/origin/staging"} {
+		if _, err := repo.Reference(name, false); err != plumbing.ErrReferenceNotFound {
+			t.Fatalf("expected %s to be removed, got: %v", name, err)
+		}
+	}
+}
+
+func TestValidateBranches(t *testing.T) {
+	testcases := []struct {
+		name     string
+		branches []string
+		preview  *PreviewConfig
+		err      error
+	}{
+		{
+			name:     "test branches with slashes",
+			branches: []string{"main", "release/v1", "feature/foo-bar"},
+		},
+		{
+			name:     "test branches deployed to the same directory",
+			branches: []string{"release/v1", "release-v1"},
+			err:      fmt.Errorf("repository config branches %q and %q are deployed to the same directory", "release/v1", "release-v1"),
+		},
+		{
+			name:     "test branch deployed to the previews directory",
+			branches: []string{"main", "previews"},
+			preview:  &PreviewConfig{},
+			err:      fmt.Errorf("repository config branch %q is deployed to the previews directory", "previews"),
+		},
+		{
+			name:     "test branch named previews without previews",
+			branches: []string{"main", "previews"},
+		},
+		{
+			name:     "test branch with parent directory",
+			branches: []string{"main", "../../etc"},
+			err:      fmt.Errorf("repository config branch %q is malformed", "../../etc"),
+		},
+		{
+			name:     "test branch with double dots",
+			branches: []string{"foo..bar"},
+			err:      fmt.Errorf("repository config branch %q is malformed", "foo..bar"),
+		},
+		{
+			name:     "test hidden branch",
+			branches: []string{".git"},
+			err:      fmt.Errorf("repository config branch %q is malformed", ".git"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := &RepositoryConfig{
+				Address:  "https://github.com/authp/authp.github.io.git",
+				Branches: tc.branches,
+				Preview:  tc.preview,
+			}
+			err := rc.validate()
+			if tc.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+				t.Fatalf("unexpected error (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
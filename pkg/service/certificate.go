@@ -0,0 +1,120 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	cryptossh "golang.org/x/crypto/ssh"
+	"math"
+	"os"
+	"time"
+)
+
+// certificateRenewalFraction controls the expiry warning, which is reported
+// when less than 1/certificateRenewalFraction of the validity remains.
+const certificateRenewalFraction = 4
+
+// certificateRenewalWindow is the time before the expiry when the warning
+// is reported for the certificates valid since the epoch, which have no
+// validity period to take the fraction of.
+const certificateRenewalWindow = 24 * time.Hour
+
+// loadCertificate reads the OpenSSH certificate from the file.
+func loadCertificate(fp string) (*cryptossh.Certificate, error) {
+	b, err := os.ReadFile(expandDir(fp))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading ssh certificate: %v", err)
+	}
+	key, _, _, _, err := cryptossh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ssh certificate %s: %v", fp, err)
+	}
+	cert, ok := key.(*cryptossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("malformed ssh certificate %s: not a certificate", fp)
+	}
+	if cert.CertType != cryptossh.UserCert {
+		return nil, fmt.Errorf("malformed ssh certificate %s: not a user certificate", fp)
+	}
+	return cert, nil
+}
+
+// certificateExpiry returns the expiry of the certificate, or the zero time
+// when the certificate does not expire.
+func certificateExpiry(cert *cryptossh.Certificate) time.Time {
+	if cert.ValidBefore > math.MaxInt64 {
+		// The CertTimeInfinity and the times beyond the range of time.Time.
+		return time.Time{}
+	}
+	return time.Unix(int64(cert.ValidBefore), 0).UTC()
+}
+
+// certificateExpiresSoon checks whether less than 1/certificateRenewalFraction
+// of the validity period of the certificate remains at the time. For the
+// certificates valid since the epoch, the certificateRenewalWindow is used.
+func certificateExpiresSoon(cert *cryptossh.Certificate, now time.Time) bool {
+	expiresAt := certificateExpiry(cert)
+	if expiresAt.IsZero() {
+		return false
+	}
+	window := certificateRenewalWindow
+	if cert.ValidAfter > 0 && cert.ValidAfter < cert.ValidBefore {
+		validAfter := time.Unix(int64(cert.ValidAfter), 0)
+		window = expiresAt.Sub(validAfter) / certificateRenewalFraction
+	}
+	return expiresAt.Sub(now) <= window
+}
+
+// newCertificateSigner returns the signer presenting the certificate read
+// from the file. The file is read on every call to pick up renewals.
+func newCertificateSigner(signer cryptossh.Signer, fp string) (cryptossh.Signer, error) {
+	cert, err := loadCertificate(fp)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt := certificateExpiry(cert); !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("ssh certificate %s expired at %s", fp, expiresAt.Format(time.RFC3339))
+	}
+	certSigner, err := cryptossh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("ssh certificate %s does not match the key: %v", fp, err)
+	}
+	return certSigner, nil
+}
+
+// checkCertificate records the expiry of the SSH certificate and reports
+// the certificate, which is close to its expiry.
+func (r *Repository) checkCertificate() {
+	cert, err := loadCertificate(r.Config.Auth.Certificate)
+	if err != nil {
+		r.setCertificateExpiry(time.Time{})
+		return
+	}
+	expiresAt := certificateExpiry(cert)
+	r.setCertificateExpiry(expiresAt)
+	now := time.Now()
+	if !certificateExpiresSoon(cert, now) {
+		return
+	}
+	remaining := expiresAt.Sub(now)
+	r.logger.Warn(
+		"ssh certificate expires soon",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("certificate", r.Config.Auth.Certificate),
+		zap.Time("expires_at", expiresAt),
+		zap.Duration("remaining", remaining),
+	)
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+func TestRepositoryUpdateCertificate(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caSigner, _ := cryptossh.NewSignerFromKey(caKey)
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	clientSigner, _ := cryptossh.NewSignerFromKey(clientKey)
+	checker := &cryptossh.CertChecker{
+		IsUserAuthority: func(auth cryptossh.PublicKey) bool {
+			return string(auth.Marshal()) == string(caSigner.PublicKey().Marshal())
+		},
+	}
+	server := newTestSSHServer(t, &cryptossh.ServerConfig{PublicKeyCallback: checker.Authenticate})
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	der, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("failed marshaling private key: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed writing private key: %v", err)
+	}
+	certFile := keyFile + "-cert.pub"
+	writeCertificate := func(validAfter, validBefore time.Time) {
+		cert := &cryptossh.Certificate{
+			Key:             clientSigner.PublicKey(),
+			CertType:        cryptossh.UserCert,
+			KeyId:           "caddy",
+			ValidPrincipals: []string{"git"},
+			ValidAfter:      uint64(validAfter.Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			t.Fatalf("failed signing certificate: %v", err)
+		}
+		if err := os.WriteFile(certFile, cryptossh.MarshalAuthorizedKey(cert), 0600); err != nil {
+			t.Fatalf("failed writing certificate: %v", err)
+		}
+	}
+
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: server.url(upstream.bareDir),
+		Auth: &AuthConfig{
+			KeyPath:     keyFile,
+			Certificate: certFile,
+			HostKeys:    []string{string(cryptossh.MarshalAuthorizedKey(server.hostKeys[1].PublicKey()))},
+		},
+	})
+
+	// The expired certificate is rejected before connecting.
+	now := time.Now()
+	writeCertificate(now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if err := r.update(); err == nil {
+		t.Fatalf("expected expired certificate error")
+	}
+
+	// The renewed certificate is used by the next update.
+	expiresAt := now.Add(time.Hour).Truncate(time.Second).UTC()
+	writeCertificate(now.Add(-time.Hour), expiresAt)
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo with renewed certificate: %v", err)
+	}
+	got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+	if diff := cmp.Diff("v1", got); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(expiresAt, r.Status().CertificateExpiresAt); diff != "" {
+		t.Fatalf("unexpected certificate expiry (-want +got):\n%s", diff)
+	}
+
+	// The key without the certificate is not accepted by the server.
+	r.Config.Auth.Certificate = ""
+	upstream.commit("update", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected authentication error without certificate")
+	}
+}
+
+func TestCertificateExpiresSoon(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) uint64 {
+		return uint64(now.Add(d).Unix())
+	}
+	for _, tc := range []struct {
+		name        string
+		validAfter  uint64
+		validBefore uint64
+		want        bool
+	}{
+		{
+			name:        "test certificate in the first quarter of validity",
+			validAfter:  at(-time.Hour),
+			validBefore: at(3 * time.Hour),
+		},
+		{
+			name:        "test certificate in the last quarter of validity",
+			validAfter:  at(-3 * time.Hour),
+			validBefore: at(time.Hour),
+			want:        true,
+		},
+		{
+			name:        "test expired certificate",
+			validAfter:  at(-2 * time.Hour),
+			validBefore: at(-time.Hour),
+			want:        true,
+		},
+		{
+			name:        "test certificate without expiry",
+			validAfter:  at(-time.Hour),
+			validBefore: cryptossh.CertTimeInfinity,
+		},
+		{
+			name:        "test certificate without expiry valid since epoch",
+			validBefore: cryptossh.CertTimeInfinity,
+		},
+		{
+			name:        "test certificate beyond time range",
+			validBefore: math.MaxInt64 + 1,
+		},
+		{
+			name:        "test certificate valid since epoch",
+			validBefore: at(48 * time.Hour),
+		},
+		{
+			name:        "test certificate valid since epoch expiring within a day",
+			validBefore: at(12 * time.Hour),
+			want:        true,
+		},
+		{
+			name:        "test certificate with validity reversed",
+			validAfter:  at(72 * time.Hour),
+			validBefore: at(48 * time.Hour),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cert := &cryptossh.Certificate{ValidAfter: tc.validAfter, ValidBefore: tc.validBefore}
+			if got := certificateExpiresSoon(cert, now); got != tc.want {
+				t.Fatalf("unexpected result: %t, want: %t", got, tc.want)
+			}
+		})
+	}
+}
@@ -15,30 +15,85 @@
 package service
 
 import (
+	"encoding/json"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/greenpau/caddy-git/pkg/errors"
+	cryptossh "golang.org/x/crypto/ssh"
+	"net/http"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Config is a configuration of Manager.
 type Config struct {
 	Repositories []*RepositoryConfig `json:"repositories,omitempty"`
 	repoMap      map[string]*RepositoryConfig
+	storage      Storage
 }
 
 // AuthConfig is authentication configuration in RepositoryConfig.
 type AuthConfig struct {
-	Username                      string `json:"username,omitempty"`
-	Password                      string `json:"password,omitempty"`
-	KeyPath                       string `json:"key_path,omitempty"`
-	KeyPassphrase                 string `json:"key_passphrase,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password Secret `json:"password,omitempty"`
+	// The token sent as the bearer token, or as the password, when the
+	// username is set.
+	Token Secret `json:"token,omitempty"`
+	// The files holding the password, the token, and the passphrase of the
+	// key. The files are read before every update.
+	PasswordFile      string `json:"password_file,omitempty"`
+	TokenFile         string `json:"token_file,omitempty"`
+	KeyPassphraseFile string `json:"key_passphrase_file,omitempty"`
+	// The PEM encoded private key used instead of the key file.
+	KeyData Secret `json:"key_data,omitempty"`
+	// Agent enables the authentication with the keys of SSH agent listening
+	// on the socket, or on SSH_AUTH_SOCK, when the socket is not set.
+	Agent       bool   `json:"agent,omitempty"`
+	AgentSocket string `json:"agent_socket,omitempty"`
+	KeyPath     string `json:"key_path,omitempty"`
+	// KeyAuto enables the authentication with the deploy key generated on
+	// the first start and kept in the storage.
+	KeyAuto       bool   `json:"key_auto,omitempty"`
+	KeyPassphrase Secret `json:"key_passphrase,omitempty"`
+	// The OpenSSH user certificate of the key. The certificate is read before
+	// every update.
+	Certificate                   string `json:"certificate,omitempty"`
 	StrictHostKeyCheckingDisabled bool   `json:"strict_host_key_checking_disabled,omitempty"`
+	// The known hosts file used to verify the host key of SSH remote,
+	// instead of the known hosts files of the user.
+	KnownHosts string `json:"known_hosts,omitempty"`
+	// The pinned host keys in "<type> <base64>" format.
+	HostKeys []string `json:"host_keys,omitempty"`
+	// The pinned SHA256 fingerprints of the host keys.
+	HostKeyFingerprints []string `json:"host_key_fingerprints,omitempty"`
+	// The installation of GitHub App issuing the access tokens.
+	GitHubApp *GitHubAppConfig `json:"github_app,omitempty"`
+}
+
+// GitHubAppConfig is a configuration of GitHub App authentication in
+// AuthConfig. The installation access tokens are used for HTTPS basic auth.
+type GitHubAppConfig struct {
+	// The ID of the App, or its client ID.
+	AppID string `json:"app_id,omitempty"`
+	// The ID of the installation of the App in the organization or account
+	// owning the repository.
+	InstallationID int64 `json:"installation_id,omitempty"`
+	// The file with PEM encoded private key of the App.
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	// The URL of GitHub API. By default, it is https://api.github.com.
+	APIURL    string `json:"api_url,omitempty"`
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
 }
 
 // WebhookConfig is a webhook configuration in RepositoryConfig.
 type WebhookConfig struct {
 	Name   string `json:"name,omitempty"`
 	Header string `json:"header,omitempty"`
-	Secret string `json:"secret,omitempty"`
+	Secret Secret `json:"secret,omitempty"`
 }
 
 // ExecConfig is an execution script configuration in RepositoryConfig.
@@ -48,6 +103,59 @@ type ExecConfig struct {
 	Args    []string `json:"args,omitempty"`
 }
 
+// PublishConfig is a configuration of a directory published from the
+// Repository in RepositoryConfig.
+type PublishConfig struct {
+	// The directory inside the Repository, e.g. public.
+	Source string `json:"source,omitempty"`
+	// The directory where the files are being published.
+	Destination string `json:"destination,omitempty"`
+}
+
+// PreviewConfig is a configuration of the preview deployments of pull
+// requests and branches in RepositoryConfig.
+type PreviewConfig struct {
+	// The directory where the previews are being deployed. By default, it is
+	// the previews directory inside the directory of the Repository.
+	Dir string `json:"dir,omitempty"`
+	// The host pattern mapping hosts to previews, e.g. *.preview.example.com.
+	Host string `json:"host,omitempty"`
+	// The time in seconds after which a preview, which has not been updated,
+	// is removed.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// SignatureConfig is a configuration of the commit signature verification
+// in RepositoryConfig.
+type SignatureConfig struct {
+	// The files with the trusted armored OpenPGP public keys.
+	GPGKeys []string `json:"gpg_keys,omitempty"`
+	// The file with the trusted SSH signers in the allowed signers format of
+	// ssh-keygen(1).
+	AllowedSigners string `json:"allowed_signers,omitempty"`
+	// The commits being verified, i.e. head (default) or all new commits.
+	Commits string `json:"commits,omitempty"`
+}
+
+// TLSConfig is a configuration of TLS for HTTPS remotes in RepositoryConfig.
+type TLSConfig struct {
+	// The file with PEM encoded certificates of the trusted CAs, used
+	// instead of the system ones.
+	CAFile string `json:"ca_file,omitempty"`
+	// The files with PEM encoded client certificate and its key.
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// Whether the server certificate is not verified.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// LFSConfig is a configuration of Git LFS in RepositoryConfig.
+type LFSConfig struct {
+	// The URL of LFS server. By default, it is derived from the address of
+	// the Repository, e.g. https://github.com/authp/authp.github.io.git/info/lfs.
+	URL string `json:"url,omitempty"`
+}
+
 // RepositoryConfig is a configuration of Repository.
 type RepositoryConfig struct {
 	// The alias for the Repository.
@@ -56,16 +164,110 @@ type RepositoryConfig struct {
 	Address string `json:"address,omitempty"`
 	// The directory where the Repository is being stored locally.
 	BaseDir string `json:"base_dir,omitempty"`
-	Branch  string `json:"branch,omitempty"`
-	Depth   int    `json:"depth,omitempty"`
+	// The directory where the metadata of the Repository is being stored.
+	// By default, it is the .git directory inside the checkout.
+	GitDir string `json:"git_dir,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	// The branches deployed side by side, each into its own directory.
+	Branches []string `json:"branches,omitempty"`
+	Depth    int      `json:"depth,omitempty"`
+	// Prune removes the remote-tracking branches deleted on the remote.
+	Prune bool `json:"prune,omitempty"`
+	// NoTags disables fetching of tags.
+	NoTags bool `json:"no_tags,omitempty"`
+	// The maximum size in bytes of the cache of git objects. By default, it
+	// is 96MB.
+	CacheSize int64 `json:"cache_size,omitempty"`
+	// The maximum size in bytes of the git objects read into memory. The
+	// larger objects are streamed from the packfiles.
+	LargeObjectThreshold int64 `json:"large_object_threshold,omitempty"`
+	// The mode of the Repository, i.e. checkout (default) or mirror.
+	Mode string `json:"mode,omitempty"`
+	// The deployment method of the Repository, i.e. checkout (default) or
+	// export. The export writes the tree without git metadata.
+	Deploy string `json:"deploy,omitempty"`
+	// The handling of the corrupt repository directory, i.e. fail (default),
+	// quarantine or reclone.
+	OnCorrupt string `json:"on_corrupt,omitempty"`
+	// The handling of the symlinks of the deployed trees, i.e. allow
+	// (default), within_repo or deny.
+	Symlinks string `json:"symlinks,omitempty"`
+	// CommitMtimes sets the modification time of each deployed file to the
+	// committer time of the last commit changing it.
+	CommitMtimes bool `json:"commit_mtimes,omitempty"`
 	// The interval at which repository updates automatically.
-	UpdateInterval int              `json:"update_interval,omitempty"`
-	Auth           *AuthConfig      `json:"auth,omitempty"`
-	Webhooks       []*WebhookConfig `json:"webhooks,omitempty"`
-	PostPullExec   []*ExecConfig    `json:"post_pull_exec,omitempty"`
-	transport      string           `json:"transport,omitempty"`
+	UpdateInterval int `json:"update_interval,omitempty"`
+	// The interval at which repository objects are repacked and pruned.
+	MaintenanceInterval int `json:"maintenance_interval,omitempty"`
+	// The interval at which the worktree is compared with the deployed
+	// commit.
+	VerifyInterval int `json:"verify_interval,omitempty"`
+	// VerifyRepair restores the deployed files changed in the worktree.
+	VerifyRepair bool        `json:"verify_repair,omitempty"`
+	Auth         *AuthConfig `json:"auth,omitempty"`
+	// The credential provider module in git.auth namespace, which provides
+	// the authentication in place of Auth.
+	AuthProviderRaw json.RawMessage  `json:"auth_provider,omitempty" caddy:"namespace=git.auth inline_key=provider"`
+	Webhooks        []*WebhookConfig `json:"webhooks,omitempty"`
+	PostPullExec    []*ExecConfig    `json:"post_pull_exec,omitempty"`
+	Publish         []*PublishConfig `json:"publish,omitempty"`
+	Preview         *PreviewConfig   `json:"preview,omitempty"`
+	// The commits are deployed only when signed by the trusted keys.
+	VerifySignatures *SignatureConfig `json:"verify_signatures,omitempty"`
+	// The LFS pointers are replaced with the content of LFS objects.
+	LFS *LFSConfig `json:"lfs,omitempty"`
+	// The TLS options of HTTPS remotes.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// The URL of the proxy of HTTP(S) remotes.
+	Proxy     string `json:"proxy,omitempty"`
+	transport string
+	endpoint  *transport.Endpoint
+	// The deploy key loaded from the storage, when KeyAuto is enabled.
+	deployKey cryptossh.Signer
+	// The HTTP client configured with the TLS and proxy options.
+	clientMu sync.Mutex
+	client   *http.Client
+	// The content of the CA file the client was configured with.
+	clientCA []byte
+	// The credential provider loaded from AuthProviderRaw.
+	authProvider CredentialProvider
+	// The client of SSH agent, when Agent is enabled.
+	agentMu sync.Mutex
+	agent   *sshAgent
 }
 
+// The modes supported by RepositoryConfig.
+const (
+	modeCheckout = "checkout"
+	modeMirror   = "mirror"
+)
+
+// The deployment methods supported by RepositoryConfig.
+const (
+	deployCheckout = "checkout"
+	deployExport   = "export"
+)
+
+// The handling of corrupt repositories supported by RepositoryConfig.
+const (
+	onCorruptFail       = "fail"
+	onCorruptQuarantine = "quarantine"
+	onCorruptReclone    = "reclone"
+)
+
+// The symlinks policies supported by RepositoryConfig.
+const (
+	symlinksAllow      = "allow"
+	symlinksWithinRepo = "within_repo"
+	symlinksDeny       = "deny"
+)
+
+// The commits verified by SignatureConfig.
+const (
+	verifyHeadCommit = "head"
+	verifyAllCommits = "all"
+)
+
 // NewConfig returns an instance of Config.
 func NewConfig() *Config {
 	return &Config{
@@ -73,6 +275,32 @@ func NewConfig() *Config {
 	}
 }
 
+// SetStorage sets the storage of the generated deploy keys.
+func (cfg *Config) SetStorage(storage Storage) {
+	cfg.storage = storage
+}
+
+// ResolveSecrets replaces the placeholders of the secrets, e.g.
+// {env.GIT_PASSWORD}, with their values.
+func (cfg *Config) ResolveSecrets(replace func(string) string) {
+	resolve := func(secret *Secret) {
+		if *secret != "" {
+			*secret = Secret(replace(string(*secret)))
+		}
+	}
+	for _, rc := range cfg.Repositories {
+		if rc.Auth != nil {
+			resolve(&rc.Auth.Password)
+			resolve(&rc.Auth.Token)
+			resolve(&rc.Auth.KeyPassphrase)
+			resolve(&rc.Auth.KeyData)
+		}
+		for _, webhook := range rc.Webhooks {
+			resolve(&webhook.Secret)
+		}
+	}
+}
+
 // NewRepositoryConfig returns an instance of RepositoryConfig.
 func NewRepositoryConfig() *RepositoryConfig {
 	return &RepositoryConfig{}
@@ -94,6 +322,9 @@ func (cfg *Config) AddRepository(rc *RepositoryConfig) error {
 	if err := rc.validate(); err != nil {
 		return err
 	}
+	if err := validatePublishDirs(append(cfg.Repositories, rc)); err != nil {
+		return err
+	}
 	cfg.Repositories = append(cfg.Repositories, rc)
 	cfg.repoMap[rc.Name] = rc
 	return nil
@@ -103,15 +334,373 @@ func (rc *RepositoryConfig) validate() error {
 	if rc.Address == "" {
 		return errors.ErrRepositoryConfigAddressEmpty
 	}
-	if !strings.HasSuffix(rc.Address, ".git") {
-		return errors.ErrRepositoryConfigAddressUnsupported.WithArgs(rc.Address)
+
+	switch rc.Mode {
+	case "", modeCheckout:
+	case modeMirror:
+		if rc.Branch != "" {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("branch", rc.Mode)
+		}
+		if rc.GitDir != "" {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("git_dir", rc.Mode)
+		}
+		if rc.Deploy != "" {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("deploy", rc.Mode)
+		}
+		if len(rc.Publish) > 0 {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("publish", rc.Mode)
+		}
+		if len(rc.Branches) > 0 {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("branches", rc.Mode)
+		}
+		if rc.Preview != nil {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("preview", rc.Mode)
+		}
+		if rc.VerifySignatures != nil {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("verify_signatures", rc.Mode)
+		}
+		if rc.LFS != nil {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("lfs", rc.Mode)
+		}
+		if rc.NoTags {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("no_tags", rc.Mode)
+		}
+		if rc.VerifyInterval > 0 {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("verify", rc.Mode)
+		}
+		if rc.Symlinks != "" {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("symlinks", rc.Mode)
+		}
+		if rc.CommitMtimes {
+			return errors.ErrRepositoryConfigModeConflict.WithArgs("commit_mtimes", rc.Mode)
+		}
+	default:
+		return errors.ErrRepositoryConfigModeUnsupported.WithArgs(rc.Mode)
+	}
+
+	switch rc.Deploy {
+	case "", deployCheckout, deployExport:
+	default:
+		return errors.ErrRepositoryConfigDeployUnsupported.WithArgs(rc.Deploy)
+	}
+	if rc.Deploy == deployExport && rc.VerifyInterval > 0 {
+		return errors.ErrRepositoryConfigDeployConflict.WithArgs("verify", rc.Deploy)
+	}
+
+	switch rc.OnCorrupt {
+	case "", onCorruptFail, onCorruptQuarantine, onCorruptReclone:
+	default:
+		return errors.ErrRepositoryConfigOnCorruptUnsupported.WithArgs(rc.OnCorrupt)
+	}
+
+	switch rc.Symlinks {
+	case "", symlinksAllow, symlinksWithinRepo, symlinksDeny:
+	default:
+		return errors.ErrRepositoryConfigSymlinksUnsupported.WithArgs(rc.Symlinks)
+	}
+
+	if len(rc.Branches) > 0 {
+		switch {
+		case rc.Branch != "":
+			return errors.ErrRepositoryConfigBranchesConflict.WithArgs("branch")
+		case rc.Deploy != "":
+			return errors.ErrRepositoryConfigBranchesConflict.WithArgs("deploy")
+		case len(rc.Publish) > 0:
+			return errors.ErrRepositoryConfigBranchesConflict.WithArgs("publish")
+		case rc.VerifyInterval > 0:
+			return errors.ErrRepositoryConfigBranchesConflict.WithArgs("verify")
+		}
+		deployed := make(map[string]string)
+		for _, branch := range rc.Branches {
+			if !isValidBranchName(branch) {
+				return errors.ErrRepositoryConfigBranchMalformed.WithArgs(branch)
+			}
+			name := branchDirName(branch)
+			if other, exists := deployed[name]; exists {
+				return errors.ErrRepositoryConfigBranchesCollision.WithArgs(other, branch)
+			}
+			deployed[name] = branch
+			// The previews would be removed as the stale files of the branch.
+			branchDir := filepath.Join(expandDir(rc.BaseDir), rc.Name, name)
+			if rc.Preview != nil && pathsOverlap(branchDir, rc.previewsDir()) {
+				return errors.ErrRepositoryConfigBranchPreviewsOverlap.WithArgs(branch)
+			}
+		}
+	}
+
+	for _, pc := range rc.Publish {
+		if err := pc.validate(); err != nil {
+			return err
+		}
+	}
+
+	// The previews are created and removed by the webhook events, which
+	// must be authenticated.
+	if rc.Preview != nil && len(rc.Webhooks) == 0 {
+		return errors.ErrRepositoryConfigPreviewWebhookRequired
+	}
+	if rc.Preview != nil && rc.Preview.Host != "" && strings.Count(rc.Preview.Host, "*") != 1 {
+		return errors.ErrRepositoryConfigPreviewHostMalformed.WithArgs(rc.Preview.Host)
+	}
+
+	if rc.VerifySignatures != nil {
+		if err := rc.VerifySignatures.validate(); err != nil {
+			return err
+		}
+		if rc.VerifySignatures.Commits == verifyAllCommits && rc.Depth > 0 {
+			// The new commits beyond the depth are not fetched.
+			return errors.ErrRepositoryConfigSignersDepth
+		}
+	}
+
+	tr, ep, err := parseAddress(rc.Address)
+	if err != nil {
+		return err
+	}
+	rc.transport = tr
+	rc.endpoint = ep
+
+	if rc.Auth != nil {
+		if err := rc.Auth.validate(rc.transport); err != nil {
+			return err
+		}
+	}
+	if rc.AuthProviderRaw != nil || rc.authProvider != nil {
+		if rc.Auth != nil {
+			return errors.ErrRepositoryConfigAuthProviderConflict
+		}
+		if !isHTTPTransport(rc.transport) && !isSSHTransport(rc.transport) {
+			return errors.ErrRepositoryConfigAuthUnsupported.WithArgs(rc.transport)
+		}
+	}
+	for _, webhook := range rc.Webhooks {
+		if webhook.Secret.redacted() {
+			return errors.ErrRepositoryConfigSecretRedacted.WithArgs("webhook")
+		}
+	}
+
+	if rc.LFS != nil && rc.lfsEndpoint() == "" {
+		return errors.ErrRepositoryConfigLFSURLRequired.WithArgs(rc.transport)
+	}
+
+	// The TLS and proxy options apply to HTTP(S) remotes and LFS servers.
+	if !isHTTPTransport(rc.transport) && rc.LFS == nil {
+		switch {
+		case rc.TLS != nil:
+			return errors.ErrRepositoryConfigHTTPOptionUnsupported.WithArgs("tls", rc.transport)
+		case rc.Proxy != "":
+			return errors.ErrRepositoryConfigHTTPOptionUnsupported.WithArgs("proxy", rc.transport)
+		}
+	}
+	if rc.TLS != nil && (rc.TLS.ClientCert == "") != (rc.TLS.ClientKey == "") {
+		return errors.ErrRepositoryConfigTLSClientIncomplete
+	}
+	if rc.Proxy != "" {
+		u, err := url.Parse(rc.Proxy)
+		if err != nil || u.Host == "" {
+			return errors.ErrRepositoryConfigProxyMalformed.WithArgs(rc.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return errors.ErrRepositoryConfigProxyMalformed.WithArgs(rc.Proxy)
+		}
+	}
+	return nil
+}
+
+func (ac *AuthConfig) validate(tr string) error {
+	for _, secret := range []struct {
+		name  string
+		value Secret
+	}{
+		{"password", ac.Password},
+		{"token", ac.Token},
+		{"passphrase", ac.KeyPassphrase},
+		{"key_data", ac.KeyData},
+	} {
+		if secret.value.redacted() {
+			return errors.ErrRepositoryConfigSecretRedacted.WithArgs(secret.name)
+		}
 	}
 
 	switch {
-	case strings.HasPrefix(rc.Address, "https://"), strings.HasPrefix(rc.Address, "http://"):
-		rc.transport = "http"
+	case ac.Password != "" && ac.PasswordFile != "":
+		return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("password", "password_file")
+	case ac.Token != "" && ac.TokenFile != "":
+		return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("token", "token_file")
+	case ac.KeyPassphrase != "" && ac.KeyPassphraseFile != "":
+		return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("passphrase", "passphrase_file")
+	case ac.KeyPath != "" && ac.KeyData != "":
+		return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("key", "key_data")
+	case ac.KeyAuto && (ac.KeyPath != "" || ac.KeyData != ""):
+		return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("key auto", "key")
+	case ac.Agent && (ac.KeyPath != "" || ac.KeyData != "" || ac.KeyAuto):
+		return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("agent", "key")
+	case ac.Certificate != "" && ac.KeyPath == "" && ac.KeyData == "" && !ac.KeyAuto:
+		return errors.ErrRepositoryConfigAuthCertificateKeyless
+	}
+
+	hasToken := ac.Token != "" || ac.TokenFile != ""
+	if ac.GitHubApp != nil {
+		if ac.Username != "" || ac.Password != "" || ac.PasswordFile != "" || hasToken {
+			return errors.ErrRepositoryConfigAuthSecretConflict.WithArgs("github_app", "username, password and token")
+		}
+		if err := ac.GitHubApp.validate(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case isHTTPTransport(tr):
+		switch {
+		case ac.KeyPath != "" || ac.KeyAuto:
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("key", tr)
+		case ac.KeyData != "":
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("key_data", tr)
+		case ac.Agent:
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("agent", tr)
+		case ac.Certificate != "":
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("certificate", tr)
+		case hasToken && (ac.Password != "" || ac.PasswordFile != ""):
+			return errors.ErrRepositoryConfigAuthTokenConflict
+		case ac.KnownHosts != "":
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("known_hosts", tr)
+		case len(ac.HostKeys) > 0 || len(ac.HostKeyFingerprints) > 0:
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("host_key", tr)
+		}
+	case isSSHTransport(tr):
+		switch {
+		case hasToken:
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("token", tr)
+		case ac.GitHubApp != nil:
+			return errors.ErrRepositoryConfigAuthTypeMismatch.WithArgs("github_app", tr)
+		}
 	default:
-		rc.transport = "ssh"
+		return errors.ErrRepositoryConfigAuthUnsupported.WithArgs(tr)
+	}
+
+	pinned := ac.KnownHosts != "" || len(ac.HostKeys) > 0 || len(ac.HostKeyFingerprints) > 0
+	if pinned && ac.StrictHostKeyCheckingDisabled {
+		return errors.ErrRepositoryConfigHostKeyConflict
+	}
+	// The pinned host keys are carried by the SSH authentication.
+	if pinned && ac.KeyPath == "" && ac.KeyData == "" && !ac.KeyAuto && !ac.Agent && ac.Username == "" {
+		return errors.ErrRepositoryConfigHostKeyCredentialless
+	}
+	for _, s := range ac.HostKeys {
+		if _, err := parseHostKey(s); err != nil {
+			return errors.ErrRepositoryConfigHostKeyMalformed.WithArgs(s)
+		}
+	}
+	for _, s := range ac.HostKeyFingerprints {
+		if !isHostKeyFingerprint(s) {
+			return errors.ErrRepositoryConfigHostKeyMalformed.WithArgs(s)
+		}
+	}
+	return nil
+}
+
+func (pc *PublishConfig) validate() error {
+	if pc.Source == "" || pc.Destination == "" {
+		return errors.ErrRepositoryConfigPublishMalformed.WithArgs(pc.Source, pc.Destination)
+	}
+	for _, part := range strings.Split(pc.Source, "/") {
+		if part == ".." {
+			return errors.ErrRepositoryConfigPublishMalformed.WithArgs(pc.Source, pc.Destination)
+		}
+	}
+	return nil
+}
+
+// validatePublishDirs checks that the publish destinations do not overlap
+// each other, nor the directories of the repositories, because the files in
+// the destinations, which are not published, are removed.
+func validatePublishDirs(repos []*RepositoryConfig) error {
+	type dirEntry struct {
+		path        string
+		destination bool
+	}
+	var dirs []dirEntry
+	for _, rc := range repos {
+		dirs = append(dirs, dirEntry{path: filepath.Join(expandDir(rc.BaseDir), rc.Name)})
+		if rc.GitDir != "" {
+			dirs = append(dirs, dirEntry{path: expandDir(rc.GitDir)})
+		}
+		if rc.Preview != nil && rc.Preview.Dir != "" {
+			dirs = append(dirs, dirEntry{path: expandDir(rc.Preview.Dir)})
+		}
+		for _, pc := range rc.Publish {
+			dirs = append(dirs, dirEntry{path: expandDir(pc.Destination), destination: true})
+		}
+	}
+	for i, a := range dirs {
+		for _, b := range dirs[i+1:] {
+			if !a.destination && !b.destination {
+				continue
+			}
+			if pathsOverlap(a.path, b.path) {
+				if !a.destination {
+					a, b = b, a
+				}
+				return errors.ErrRepositoryConfigPublishOverlap.WithArgs(a.path, b.path)
+			}
+		}
+	}
+	return nil
+}
+
+// pathsOverlap checks whether the paths are the same, or one of them is
+// inside the other.
+func pathsOverlap(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	for _, rel := range []string{relPath(a, b), relPath(b, a)} {
+		if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns the path of target relative to base, or "..", when it
+// cannot be made relative.
+func relPath(base, target string) string {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return ".."
+	}
+	return rel
+}
+
+func (sc *SignatureConfig) validate() error {
+	if len(sc.GPGKeys) == 0 && sc.AllowedSigners == "" {
+		return errors.ErrRepositoryConfigSignersEmpty
+	}
+	switch sc.Commits {
+	case "", verifyHeadCommit, verifyAllCommits:
+	default:
+		return errors.ErrRepositoryConfigSignersCommits.WithArgs(sc.Commits)
+	}
+	return nil
+}
+
+func (gc *GitHubAppConfig) validate() error {
+	switch {
+	case gc.AppID == "":
+		return errors.ErrRepositoryConfigGitHubAppIncomplete.WithArgs("app_id")
+	case gc.InstallationID <= 0:
+		return errors.ErrRepositoryConfigGitHubAppIncomplete.WithArgs("installation_id")
+	case gc.PrivateKeyFile == "":
+		return errors.ErrRepositoryConfigGitHubAppIncomplete.WithArgs("private_key_file")
+	}
+	if gc.APIURL != "" {
+		u, err := url.Parse(gc.APIURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.ErrRepositoryConfigGitHubAppURLMalformed.WithArgs(gc.APIURL)
+		}
 	}
 	return nil
 }
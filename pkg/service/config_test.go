@@ -0,0 +1,227 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateRepositoryConfig(t *testing.T) {
+	testcases := []struct {
+		name      string
+		address   string
+		auth      *AuthConfig
+		want      string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:    "test https address",
+			address: "https://github.com/authp/authp.github.io.git",
+			want:    "https",
+		},
+		{
+			name:    "test http address without git suffix",
+			address: "http://gitea.local/authp/authp.github.io",
+			want:    "http",
+		},
+		{
+			name:    "test https address with basic auth",
+			address: "https://github.com/authp/authp.github.io.git",
+			auth:    &AuthConfig{Username: "foo", Password: "bar"},
+			want:    "https",
+		},
+		{
+			name:    "test ssh address",
+			address: "ssh://git@github.com:22/authp/authp.github.io.git",
+			auth:    &AuthConfig{KeyPath: "~/.ssh/id_rsa"},
+			want:    "ssh",
+		},
+		{
+			name:    "test scp-like address",
+			address: "git@github.com:authp/authp.github.io.git",
+			auth:    &AuthConfig{KeyPath: "~/.ssh/id_rsa"},
+			want:    "scp",
+		},
+		{
+			name:    "test git daemon address",
+			address: "git://git.kernel.org/pub/scm/git/git.git",
+			want:    "git",
+		},
+		{
+			name:    "test file address",
+			address: "file:///srv/mirrors/authp.github.io.git",
+			want:    "file",
+		},
+		{
+			name:    "test local path address",
+			address: "/srv/mirrors/authp.github.io",
+			want:    "file",
+		},
+		{
+			name:      "test https address with key auth",
+			address:   "https://github.com/authp/authp.github.io.git",
+			auth:      &AuthConfig{KeyPath: "~/.ssh/id_rsa"},
+			shouldErr: true,
+			err:       fmt.Errorf("repository config key auth is unsupported for https transport"),
+		},
+		{
+			name:      "test git daemon address with auth",
+			address:   "git://git.kernel.org/pub/scm/git/git.git",
+			auth:      &AuthConfig{Username: "foo", Password: "bar"},
+			shouldErr: true,
+			err:       fmt.Errorf("repository config auth is unsupported for git transport"),
+		},
+		{
+			name:      "test local path address with auth",
+			address:   "/srv/mirrors/authp.github.io",
+			auth:      &AuthConfig{KeyPath: "~/.ssh/id_rsa"},
+			shouldErr: true,
+			err:       fmt.Errorf("repository config auth is unsupported for file transport"),
+		},
+		{
+			name:      "test unsupported address scheme",
+			address:   "ftp://example.com/authp.github.io.git",
+			shouldErr: true,
+			err:       fmt.Errorf("repository config address %q is unsupported", "ftp://example.com/authp.github.io.git"),
+		},
+		{
+			name:      "test empty address",
+			shouldErr: true,
+			err:       fmt.Errorf("repository config address is empty"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := NewRepositoryConfig()
+			rc.Name = "foo"
+			rc.Address = tc.address
+			rc.Auth = tc.auth
+			err := rc.validate()
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(err.Error(), tc.err.Error()); diff != "" {
+					t.Fatalf("unexpected error: %v, want: %v", err, tc.err)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, rc.transport); diff != "" {
+				t.Errorf("validate() transport mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidatePublishDirs(t *testing.T) {
+	testcases := []struct {
+		name  string
+		repos []*RepositoryConfig
+		err   error
+	}{
+		{
+			name: "test separate destinations",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/var/www/docs"},
+					{Source: "blog", Destination: "/var/www/blog"},
+				}},
+				{Name: "bar", BaseDir: "/srv/git"},
+			},
+		},
+		{
+			name: "test destination is repository directory",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/srv/git/foo"},
+				}},
+			},
+			err: fmt.Errorf("repository config publish destination %q overlaps %q", "/srv/git/foo", "/srv/git/foo"),
+		},
+		{
+			name: "test destination is ancestor of repository directory",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/srv"},
+				}},
+			},
+			err: fmt.Errorf("repository config publish destination %q overlaps %q", "/srv", "/srv/git/foo"),
+		},
+		{
+			name: "test destination inside repository directory",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/srv/git/foo/public"},
+				}},
+			},
+			err: fmt.Errorf("repository config publish destination %q overlaps %q", "/srv/git/foo/public", "/srv/git/foo"),
+		},
+		{
+			name: "test destination is git dir",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git", GitDir: "/srv/meta/foo.git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/srv/meta"},
+				}},
+			},
+			err: fmt.Errorf("repository config publish destination %q overlaps %q", "/srv/meta", "/srv/meta/foo.git"),
+		},
+		{
+			name: "test destination is another repository",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git"},
+				{Name: "bar", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/srv/git/foo"},
+				}},
+			},
+			err: fmt.Errorf("repository config publish destination %q overlaps %q", "/srv/git/foo", "/srv/git/foo"),
+		},
+		{
+			name: "test destinations overlap each other",
+			repos: []*RepositoryConfig{
+				{Name: "foo", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "docs", Destination: "/var/www"},
+				}},
+				{Name: "bar", BaseDir: "/srv/git", Publish: []*PublishConfig{
+					{Source: "blog", Destination: "/var/www/blog"},
+				}},
+			},
+			err: fmt.Errorf("repository config publish destination %q overlaps %q", "/var/www", "/var/www/blog"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePublishDirs(tc.repos)
+			if tc.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+				t.Fatalf("unexpected error (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
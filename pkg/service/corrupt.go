@@ -0,0 +1,130 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+// quarantineTimeFormat is the format of the timestamp in the name of the
+// quarantined directory.
+const quarantineTimeFormat = "20060102T150405Z"
+
+// recoverRepository checks the repository directories left by the previous
+// updates. When the repository is corrupt, e.g. by an interrupted clone, or
+// the directory is not a repository at all, the directories are handled as
+// configured by on_corrupt, so that the update clones the repository again.
+func (r *Repository) recoverRepository(repoDir string) error {
+	gitDir := r.metadataDir()
+	dirs := []string{gitDir}
+	existsDir := gitDir
+	resolveHead := true
+	switch {
+	case r.Config.Mode == modeMirror:
+	case len(r.Config.Branches) > 0:
+		// The repository is initialized without the commit of HEAD.
+		resolveHead = false
+	case r.Config.Deploy == deployExport:
+	default:
+		// The checkout is removed along with its metadata.
+		dirs = []string{repoDir}
+		if r.Config.GitDir != "" {
+			dirs = append(dirs, gitDir)
+		} else {
+			existsDir = repoDir
+		}
+	}
+
+	exists, err := dirExists(existsDir)
+	if err != nil || !exists {
+		return err
+	}
+	checkErr := r.checkRepository(gitDir, resolveHead)
+	if checkErr == nil {
+		return nil
+	}
+
+	switch r.Config.OnCorrupt {
+	case onCorruptQuarantine:
+		suffix := ".corrupt-" + time.Now().UTC().Format(quarantineTimeFormat)
+		var quarantined []string
+		for _, dir := range dirs {
+			if exists, err := dirExists(dir); err != nil {
+				return err
+			} else if !exists {
+				continue
+			}
+			if err := os.Rename(dir, dir+suffix); err != nil {
+				return err
+			}
+			quarantined = append(quarantined, dir+suffix)
+		}
+		r.logger.Warn(
+			"quarantined corrupt repo",
+			zap.String("repo_name", r.Config.Name),
+			zap.Strings("quarantine_dirs", quarantined),
+			zap.Error(checkErr),
+		)
+	case onCorruptReclone:
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+		r.logger.Warn(
+			"removed corrupt repo",
+			zap.String("repo_name", r.Config.Name),
+			zap.Strings("dirs", dirs),
+			zap.Error(checkErr),
+		)
+	default:
+		return fmt.Errorf("repository in %s is corrupt: %v", gitDir, checkErr)
+	}
+	return nil
+}
+
+// checkRepository checks that the repository in gitDir opens and, unless
+// resolveHead is false, that HEAD resolves to a commit, which tree is
+// readable from the object store.
+func (r *Repository) checkRepository(gitDir string, resolveHead bool) error {
+	repo, err := r.openBare(gitDir)
+	if err != nil {
+		return err
+	}
+	if !resolveHead {
+		return nil
+	}
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound && r.Config.Deploy == deployExport {
+		// The local branch of the export is created, once the tip is
+		// verified.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unresolved HEAD: %v", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("unreadable HEAD commit %s: %v", head.Hash(), err)
+	}
+	if _, err := commit.Tree(); err != nil {
+		return fmt.Errorf("unreadable HEAD tree %s: %v", commit.TreeHash, err)
+	}
+	return nil
+}
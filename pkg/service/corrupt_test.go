@@ -0,0 +1,133 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepositoryUpdateCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		deploy    string
+		onCorrupt string
+		// corrupt damages the repository in repoDir and its metadata in
+		// gitDir. The repository is not cloned before, when nil.
+		corrupt        func(t *testing.T, repoDir, gitDir string)
+		shouldErr      bool
+		wantQuarantine int
+	}{
+		{
+			name:      "test non-repo directory is recloned",
+			onCorrupt: "reclone",
+		},
+		{
+			name:      "test missing HEAD is quarantined",
+			onCorrupt: "quarantine",
+			corrupt: func(t *testing.T, repoDir, gitDir string) {
+				removeTestFiles(t, filepath.Join(gitDir, "refs", "heads", "*"), filepath.Join(gitDir, "packed-refs"))
+			},
+			wantQuarantine: 1,
+		},
+		{
+			name: "test corrupt object store fails",
+			corrupt: func(t *testing.T, repoDir, gitDir string) {
+				removeTestFiles(t, filepath.Join(gitDir, "objects", "pack", "*"), filepath.Join(gitDir, "objects", "??"))
+			},
+			shouldErr: true,
+		},
+		{
+			name:      "test corrupt object store of export is recloned",
+			deploy:    "export",
+			onCorrupt: "reclone",
+			corrupt: func(t *testing.T, repoDir, gitDir string) {
+				removeTestFiles(t, filepath.Join(gitDir, "objects", "pack", "*"), filepath.Join(gitDir, "objects", "??"))
+			},
+		},
+		{
+			name:      "test corrupt object store of export is quarantined",
+			deploy:    "export",
+			onCorrupt: "quarantine",
+			corrupt: func(t *testing.T, repoDir, gitDir string) {
+				removeTestFiles(t, filepath.Join(gitDir, "objects", "pack", "*"), filepath.Join(gitDir, "objects", "??"))
+			},
+			wantQuarantine: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address:   upstream.bareDir,
+				Deploy:    tc.deploy,
+				OnCorrupt: tc.onCorrupt,
+			})
+			repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+			if tc.corrupt == nil {
+				if err := os.MkdirAll(repoDir, 0755); err != nil {
+					t.Fatalf("failed creating directory: %v", err)
+				}
+				if err := os.WriteFile(filepath.Join(repoDir, "index.html"), []byte("stale"), 0644); err != nil {
+					t.Fatalf("failed writing file: %v", err)
+				}
+			} else {
+				if err := r.update(); err != nil {
+					t.Fatalf("failed cloning repo: %v", err)
+				}
+				tc.corrupt(t, repoDir, r.metadataDir())
+			}
+
+			upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+			err := r.update()
+			if tc.shouldErr {
+				if err == nil || !strings.Contains(err.Error(), "is corrupt") {
+					t.Fatalf("expected corrupt repository error, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed updating corrupt repo: %v", err)
+			}
+			if diff := cmp.Diff("v2", readTestFile(t, filepath.Join(repoDir, "index.html"))); diff != "" {
+				t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+			}
+			quarantined, _ := filepath.Glob(filepath.Join(r.Config.BaseDir, "*.corrupt-*"))
+			if diff := cmp.Diff(tc.wantQuarantine, len(quarantined)); diff != "" {
+				t.Fatalf("unexpected quarantined directories %v (-want +got):\n%s", quarantined, diff)
+			}
+		})
+	}
+}
+
+func removeTestFiles(t *testing.T, patterns ...string) {
+	t.Helper()
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatalf("failed matching %s: %v", pattern, err)
+		}
+		for _, fp := range matches {
+			if err := os.RemoveAll(fp); err != nil {
+				t.Fatalf("failed removing %s: %v", fp, err)
+			}
+		}
+	}
+}
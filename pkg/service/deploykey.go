@@ -0,0 +1,165 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"go.uber.org/zap"
+	cryptossh "golang.org/x/crypto/ssh"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Storage stores the generated deploy keys. It is implemented by the
+// storage of Caddy.
+type Storage interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+	Store(ctx context.Context, key string, value []byte) error
+}
+
+// DeployKey is the public deploy key of a repository.
+type DeployKey struct {
+	Repository string `json:"repository,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+}
+
+// deployKeyRetryInterval is the interval of the updates waiting for the
+// deploy key.
+var deployKeyRetryInterval = time.Minute
+
+// deployKeyStorageKey returns the storage key of the deploy key of the
+// repository.
+func deployKeyStorageKey(name string) string {
+	return path.Join("git", "deploy_keys", name, "id_ed25519")
+}
+
+// loadDeployKey loads the deploy key of the Repository from the storage.
+// The key is generated and stored, when the storage has none.
+func (r *Repository) loadDeployKey() error {
+	if r.storage == nil {
+		return fmt.Errorf("deploy key storage is not configured")
+	}
+	ctx := context.Background()
+	storageKey := deployKeyStorageKey(r.Config.Name)
+	generated := false
+	data, err := r.storage.Load(ctx, storageKey)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if data, err = generateDeployKey(); err != nil {
+			return err
+		}
+		if err := r.storage.Store(ctx, storageKey, data); err != nil {
+			return fmt.Errorf("failed storing deploy key: %v", err)
+		}
+		generated = true
+	case err != nil:
+		return fmt.Errorf("failed loading deploy key: %v", err)
+	}
+
+	signer, err := cryptossh.ParsePrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("malformed deploy key %s: %v", storageKey, err)
+	}
+	r.Config.deployKey = signer
+	publicKey := strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(signer.PublicKey())))
+	r.setDeployKey(publicKey + " caddy-git@" + r.Config.Name)
+
+	msg := "loaded deploy key"
+	if generated {
+		msg = "generated deploy key, add it to the deploy keys of the repository"
+	}
+	r.logger.Info(
+		msg,
+		zap.String("repo_name", r.Config.Name),
+		zap.String("public_key", r.Status().DeployKey),
+	)
+	return nil
+}
+
+// awaitDeployKey checks whether the initial update of the Repository, which
+// failed with the error, may succeed once the generated deploy key is added
+// to the remote, and records the pending status then. Only the rejected
+// authentication means that the deploy key is pending.
+func (r *Repository) awaitDeployKey(err error) bool {
+	if r.Config.Auth == nil || !r.Config.Auth.KeyAuto || r.Config.deployKey == nil {
+		return false
+	}
+	if !isAuthenticationError(err) {
+		return false
+	}
+	r.setDeployKeyPending()
+	return true
+}
+
+// isAuthenticationError checks whether the error is caused by the remote
+// rejecting the credentials.
+func isAuthenticationError(err error) bool {
+	if errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// deployKeyUpdater retries the update of the Repository, which waits for the
+// deploy key, when the auto-update is disabled.
+func deployKeyUpdater(r *Repository) {
+	intervals := time.NewTicker(deployKeyRetryInterval)
+	defer intervals.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-intervals.C:
+		}
+		if err := r.update(); err != nil {
+			r.logger.Debug("deploy key is pending", zap.String("repo_name", r.Config.Name), zap.Error(err))
+			continue
+		}
+		r.logger.Info("updated repo with deploy key", zap.String("repo_name", r.Config.Name))
+		return
+	}
+}
+
+// DeployKey returns the public deploy key of the Repository, or nil when
+// the deploy key is not loaded.
+func (r *Repository) DeployKey() *DeployKey {
+	status := r.Status()
+	if status.DeployKey == "" {
+		return nil
+	}
+	return &DeployKey{Repository: status.Repository, PublicKey: status.DeployKey}
+}
+
+// generateDeployKey generates the ed25519 key and returns it PEM encoded.
+func generateDeployKey() ([]byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating deploy key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating deploy key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
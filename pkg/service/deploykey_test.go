@@ -0,0 +1,202 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// testStorage is the in-memory Storage.
+type testStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (s *testStorage) Load(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, exists := s.values[key]
+	if !exists {
+		return nil, fs.ErrNotExist
+	}
+	return value, nil
+}
+
+func (s *testStorage) Store(_ context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func TestRepositoryUpdateDeployKey(t *testing.T) {
+	storage := &testStorage{values: make(map[string][]byte)}
+	// The server accepts the deploy key found in the storage.
+	server := newTestSSHServer(t, &cryptossh.ServerConfig{
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			data, err := storage.Load(context.Background(), deployKeyStorageKey("test"))
+			if err != nil {
+				return nil, err
+			}
+			signer, err := cryptossh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	})
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	newRepository := func(storage Storage) *Repository {
+		r := newTestRepository(t, &RepositoryConfig{
+			Address: server.url(upstream.bareDir),
+			Auth: &AuthConfig{
+				KeyAuto:  true,
+				HostKeys: []string{string(cryptossh.MarshalAuthorizedKey(server.hostKeys[1].PublicKey()))},
+			},
+		})
+		r.storage = storage
+		return r
+	}
+
+	r := newRepository(storage)
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo with generated deploy key: %v", err)
+	}
+	got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+	if diff := cmp.Diff("v1", got); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+	key := r.DeployKey()
+	if key == nil || !strings.HasPrefix(key.PublicKey, "ssh-ed25519 ") {
+		t.Fatalf("unexpected deploy key: %+v", key)
+	}
+
+	// The deploy key is reused after the restart.
+	restarted := newRepository(storage)
+	if err := restarted.update(); err != nil {
+		t.Fatalf("failed cloning repo with stored deploy key: %v", err)
+	}
+	if diff := cmp.Diff(key, restarted.DeployKey()); diff != "" {
+		t.Fatalf("unexpected deploy key after restart (-want +got):\n%s", diff)
+	}
+
+	if err := newRepository(nil).update(); err == nil {
+		t.Fatalf("expected error without storage")
+	}
+}
+
+func TestNewManagerDeployKeyPending(t *testing.T) {
+	interval := deployKeyRetryInterval
+	deployKeyRetryInterval = 50 * time.Millisecond
+	defer func() {
+		deployKeyRetryInterval = interval
+		manager = nil
+	}()
+
+	// The server accepts the deploy key once it is added to the remote.
+	var added atomic.Bool
+	server := newTestSSHServer(t, &cryptossh.ServerConfig{
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			if added.Load() {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	})
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	rc := &RepositoryConfig{
+		Name:    "test",
+		BaseDir: t.TempDir(),
+		Address: server.url(upstream.bareDir),
+		Auth: &AuthConfig{
+			KeyAuto:  true,
+			HostKeys: []string{string(cryptossh.MarshalAuthorizedKey(server.hostKeys[1].PublicKey()))},
+		},
+	}
+	cfg := &Config{Repositories: []*RepositoryConfig{rc}}
+	cfg.SetStorage(&testStorage{values: make(map[string][]byte)})
+
+	m, err := NewManager(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed provisioning with pending deploy key: %v", err)
+	}
+	status := m.repos["test"].Status()
+	if !status.DeployKeyPending || !strings.HasPrefix(status.DeployKey, "ssh-ed25519 ") {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	added.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.repos["test"].Status().DeployKeyPending {
+		if time.Now().After(deadline) {
+			t.Fatalf("deploy key is still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := readTestFile(t, filepath.Join(rc.BaseDir, rc.Name, "index.html"))
+	if diff := cmp.Diff("v1", got); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewManagerDeployKeyHostKeyMismatch(t *testing.T) {
+	defer func() {
+		manager = nil
+	}()
+	server := newTestSSHServer(t, &cryptossh.ServerConfig{
+		PublicKeyCallback: func(conn cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+			return nil, io.EOF
+		},
+	})
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := cryptossh.NewSignerFromKey(otherKey)
+	rc := &RepositoryConfig{
+		Name:    "test",
+		BaseDir: t.TempDir(),
+		Address: server.url(upstream.bareDir),
+		Auth: &AuthConfig{
+			KeyAuto:  true,
+			HostKeys: []string{string(cryptossh.MarshalAuthorizedKey(otherSigner.PublicKey()))},
+		},
+	}
+	cfg := &Config{Repositories: []*RepositoryConfig{rc}}
+	cfg.SetStorage(&testStorage{values: make(map[string][]byte)})
+
+	if _, err := NewManager(cfg, zap.NewNop()); err == nil {
+		t.Fatalf("expected host key mismatch to fail provisioning")
+	}
+}
@@ -15,6 +15,7 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
@@ -29,11 +30,24 @@ import (
 	"time"
 )
 
+// The actions supported by Endpoint.
+const (
+	// ActionUpdate updates the repository.
+	ActionUpdate = "update"
+	// ActionVars sets the placeholders describing the repositories.
+	ActionVars = "vars"
+)
+
+// maxRequestBodySize is the size limit of the request body, which matches
+// the payload cap of GitHub webhooks.
+const maxRequestBodySize = 25 << 20
+
 // Endpoint handles git management requests.
 type Endpoint struct {
 	mu             sync.Mutex
 	Name           string `json:"-"`
 	Path           string `json:"path,omitempty" xml:"path,omitempty" yaml:"path,omitempty"`
+	Action         string `json:"action,omitempty" xml:"action,omitempty" yaml:"action,omitempty"`
 	RepositoryName string
 	logger         *zap.Logger
 	startedAt      time.Time
@@ -82,6 +96,17 @@ func (m *Endpoint) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http
 		return m.respondHTTP(ctx, w, r, resp)
 	}
 
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		resp["status_code"] = http.StatusBadRequest
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			resp["status_code"] = http.StatusRequestEntityTooLarge
+		}
+		m.logger.Warn("failed reading request body", zap.String("repo_name", repo.Config.Name), zap.Error(err))
+		return m.respondHTTP(ctx, w, r, resp)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 	if len(repo.Config.Webhooks) > 0 {
 		// Inspect HTTP headers for webhooks.
 		var authorized bool
@@ -110,12 +135,12 @@ func (m *Endpoint) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http
 				if hdrParts[0] != "sha256" {
 					authFailMessage = fmt.Sprintf("malformed %s header, sha256 not found", webhook.Header)
 				}
-				if err := validateSignature(r, strings.TrimSpace(hdrParts[1]), webhook.Secret); err != nil {
+				if err := validateSignature(r, strings.TrimSpace(hdrParts[1]), string(webhook.Secret)); err != nil {
 					authFailed = true
 					authFailMessage = fmt.Sprintf("signature validation failed: %v", err)
 				}
 			default:
-				if hdr != webhook.Secret {
+				if hdr != string(webhook.Secret) {
 					authFailed = true
 					authFailMessage = "auth header value mismatch"
 				}
@@ -147,6 +172,29 @@ func (m *Endpoint) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http
 		}
 	}
 
+	if repo.Config.Preview != nil {
+		action, err := repo.parsePreviewEvent(r.Header, body)
+		if err != nil {
+			m.logger.Warn("failed parsing webhook event", zap.String("repo_name", repo.Config.Name), zap.Error(err))
+			resp["status_code"] = http.StatusBadRequest
+			return m.respondHTTP(ctx, w, r, resp)
+		}
+		if action != nil {
+			if err := repo.runPreviewAction(action); err != nil {
+				m.logger.Warn(
+					"failed managing preview",
+					zap.String("repo_name", repo.Config.Name),
+					zap.String("preview_id", action.id),
+					zap.Error(err),
+				)
+				resp["status_code"] = http.StatusInternalServerError
+				return m.respondHTTP(ctx, w, r, resp)
+			}
+			resp["status_code"] = http.StatusOK
+			return m.respondHTTP(ctx, w, r, resp)
+		}
+	}
+
 	if err := repo.update(); err != nil {
 		m.logger.Warn("failed updating repo", zap.String("repo_name", repo.Config.Name), zap.Error(err))
 		resp["status_code"] = http.StatusInternalServerError
@@ -0,0 +1,444 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const exportIgnoreAttr = "export-ignore"
+
+// runExportUpdate keeps a private bare clone of the repository and writes
+// the tree at the tip of the tracked branch into publishDir. The clone is
+// stored in GitDir, or next to publishDir when GitDir is not configured.
+func (r *Repository) runExportUpdate(publishDir string) error {
+	repo, err := r.fetchBare(r.exportGitDir(publishDir))
+	if err != nil {
+		return err
+	}
+
+	commit, err := r.updateTrackedBranch(repo)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	var preserve []string
+	if r.Config.Preview != nil {
+		preserve = append(preserve, r.previewsDir())
+	}
+	if err := exportTree(tree, "", publishDir, r.newLFSStore(), preserve...); err != nil {
+		return err
+	}
+
+	r.logger.Debug(
+		"exported latest commit",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("publish_dir", publishDir),
+		zap.String("commit", commit.Hash.String()),
+	)
+	return nil
+}
+
+// exportGitDir returns the directory of the private clone used by the
+// export deployment.
+func (r *Repository) exportGitDir(publishDir string) string {
+	if r.Config.GitDir != "" {
+		return r.Config.GitDir
+	}
+	return publishDir + ".git"
+}
+
+// fetchBare clones the repository into a bare gitDir, or fetches the
+// updates when the repository exists already.
+func (r *Repository) fetchBare(gitDir string) (*git.Repository, error) {
+	gitDirExists, err := dirExists(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	if !gitDirExists {
+		opts := &git.CloneOptions{}
+		if err := configureCloneOptions(r.Config, opts); err != nil {
+			return nil, err
+		}
+		opts.SingleBranch = true
+		repo, err := r.cloneBare(gitDir, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := trackDefaultBranch(repo); err != nil {
+			return nil, err
+		}
+		// The clone points the local branch at the tip. The branch is
+		// removed, so that the tip is verified before it is deployed.
+		head, err := repo.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			return nil, err
+		}
+		if head.Type() == plumbing.SymbolicReference {
+			if err := repo.Storer.RemoveReference(head.Target()); err != nil {
+				return nil, err
+			}
+		}
+		return repo, nil
+	}
+
+	repo, err := r.openBare(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.fetch(repo); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// updateTrackedBranch moves the local branch referenced by HEAD of a bare
+// repository to its remote-tracking counterpart and returns the commit.
+// The branch is not moved when the new commits fail the verification.
+func (r *Repository) updateTrackedBranch(repo *git.Repository) (*object.Commit, error) {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return nil, err
+	}
+	branch := head.Target()
+	if head.Type() != plumbing.SymbolicReference || !branch.IsBranch() {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch.Short()), true)
+	if err != nil {
+		return nil, err
+	}
+	return r.updateBranch(repo, branch, remoteRef.Hash())
+}
+
+// updateBranch moves the local branch to the new commit, once the commit
+// passes the signature verification and the symlinks policy.
+func (r *Repository) updateBranch(repo *git.Repository, branch plumbing.ReferenceName, h plumbing.Hash) (*object.Commit, error) {
+	var old plumbing.Hash
+	if ref, err := repo.Reference(branch, true); err == nil {
+		old = ref.Hash()
+	}
+	var commit *object.Commit
+	var err error
+	if r.Config.VerifySignatures == nil || old == h {
+		commit, err = repo.CommitObject(h)
+	} else {
+		commit, err = r.verifyTip(repo, old, h)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkSymlinks(commit); err != nil {
+		return nil, err
+	}
+	if old == h {
+		return commit, nil
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, h)); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+// exportTree writes the files found under the prefix of the tree into
+// destDir. The files having export-ignore attribute are skipped. The files
+// in destDir, which are not part of the tree or preserved, are removed.
+// When the LFS store is provided, the LFS pointers are replaced with the
+// content of the objects.
+func exportTree(tree *object.Tree, prefix, destDir string, lfs *lfsStore, preserve ...string) error {
+	matcher, err := loadTreeAttributes(tree)
+	if err != nil {
+		return err
+	}
+	var pointers map[plumbing.Hash]*lfsPointer
+	if lfs != nil {
+		if pointers, err = collectLFSPointers(tree, prefix); err != nil {
+			return err
+		}
+		if err := lfs.fetch(pointers); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	prefix = strings.Trim(prefix, "/")
+	destDir = filepath.Clean(destDir)
+
+	exported := make(map[string]bool)
+	preserved := make(map[string]bool)
+	for _, fp := range preserve {
+		fp = filepath.Clean(fp)
+		preserved[fp] = true
+		for dir := filepath.Dir(fp); strings.HasPrefix(dir, destDir+string(filepath.Separator)); dir = filepath.Dir(dir) {
+			exported[dir] = true
+		}
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		name := f.Name
+		if prefix != "" {
+			if !strings.HasPrefix(name, prefix+"/") {
+				return nil
+			}
+			name = strings.TrimPrefix(name, prefix+"/")
+		}
+		if isExportIgnored(matcher, f.Name) {
+			return nil
+		}
+		fp := filepath.Join(destDir, filepath.FromSlash(name))
+		if p, exists := pointers[f.Hash]; exists {
+			if err := lfs.writeObject(destDir, fp, p, treeFilePerm(f)); err != nil {
+				return err
+			}
+		} else if err := writeTreeFile(destDir, fp, f); err != nil {
+			return err
+		}
+		exported[fp] = true
+		for dir := filepath.Dir(fp); dir != destDir; dir = filepath.Dir(dir) {
+			exported[dir] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return removeStaleFiles(destDir, exported, preserved)
+}
+
+// loadTreeAttributes reads the .gitattributes files found in the tree.
+func loadTreeAttributes(tree *object.Tree) (gitattributes.Matcher, error) {
+	var stack []gitattributes.MatchAttribute
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if path.Base(f.Name) != ".gitattributes" {
+			return nil
+		}
+		var domain []string
+		if dir := path.Dir(f.Name); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+		rd, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+		attrs, err := gitattributes.ReadAttributes(rd, domain, domain == nil)
+		if err != nil {
+			return err
+		}
+		// The attributes down the path take precedence.
+		if domain == nil {
+			stack = append(attrs, stack...)
+		} else {
+			stack = append(stack, attrs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gitattributes.NewMatcher(stack), nil
+}
+
+// isExportIgnored checks whether the file, or any of its parent
+// directories, has export-ignore attribute.
+func isExportIgnored(matcher gitattributes.Matcher, name string) bool {
+	parts := strings.Split(name, "/")
+	for i := 1; i <= len(parts); i++ {
+		results, _ := matcher.Match(parts[:i], []string{exportIgnoreAttr})
+		if attr, found := results[exportIgnoreAttr]; found && attr.IsSet() {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTreeFile writes the file from the tree to fp under root, unless the
+// file there has the same content and mode already.
+func writeTreeFile(root, fp string, f *object.File) error {
+	if err := prepareTreeDirs(root, fp); err != nil {
+		return err
+	}
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		if existing, err := os.Readlink(fp); err == nil && existing == target {
+			return nil
+		}
+		if err := prepareTreeFile(fp); err != nil {
+			return err
+		}
+		return os.Symlink(target, fp)
+	}
+
+	perm := treeFilePerm(f)
+	if fi, err := os.Lstat(fp); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm() == perm && fi.Size() == f.Size {
+		if h, err := computeFileHash(fp); err == nil && h == f.Hash {
+			return nil
+		}
+	}
+	if err := prepareTreeFile(fp); err != nil {
+		return err
+	}
+
+	rd, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return writeFileAtomic(fp, rd, perm)
+}
+
+// writeFileAtomic writes the content to a temporary file next to fp and
+// renames it to fp.
+func writeFileAtomic(fp string, rd io.Reader, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fp), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, rd); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fp)
+}
+
+// treeFilePerm returns the permissions of the file written from the tree.
+func treeFilePerm(f *object.File) os.FileMode {
+	if f.Mode == filemode.Executable {
+		return 0755
+	}
+	return 0644
+}
+
+// prepareTreeDirs creates the parent directories of fp under root. The
+// components of the path, which are not directories, e.g. the symlinks
+// written from the previous tree, are replaced, so that the file is never
+// written outside root.
+func prepareTreeDirs(root, fp string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(fp))
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path %s is outside of %s", fp, root)
+	}
+	if rel == "." {
+		return nil
+	}
+	dir := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		switch {
+		case err == nil && fi.IsDir():
+			continue
+		case err == nil:
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareTreeFile removes anything in the way of the file.
+func prepareTreeFile(fp string) error {
+	if fi, err := os.Lstat(fp); err == nil && (fi.IsDir() || fi.Mode()&os.ModeSymlink != 0) {
+		return os.RemoveAll(fp)
+	}
+	return nil
+}
+
+// computeFileHash computes the git blob hash of the file.
+func computeFileHash(fp string) (plumbing.Hash, error) {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	h := plumbing.NewHasher(plumbing.BlobObject, fi.Size())
+	if _, err := io.Copy(h, fh); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return h.Sum(), nil
+}
+
+// removeStaleFiles removes the files and directories in dir, which are not
+// in the keep list. The preserved directories are left untouched along with
+// their content.
+func removeStaleFiles(dir string, keep, preserved map[string]bool) error {
+	var stale []string
+	err := filepath.WalkDir(dir, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if preserved[fp] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fp == dir || keep[fp] {
+			return nil
+		}
+		stale = append(stale, fp)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fp := range stale {
+		if err := os.RemoveAll(fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
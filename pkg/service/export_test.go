@@ -0,0 +1,182 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// listTestFiles returns the relative paths of the files found in dir.
+func listTestFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, fp)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed listing %s: %v", dir, err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestRepositoryUpdateExport(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{
+		".gitattributes":        []byte(".gitattributes export-ignore\nscaffold export-ignore\n"),
+		"index.html":            []byte("v1"),
+		"old.html":              []byte("old"),
+		"assets/app.js":         []byte("app"),
+		"scaffold/Makefile":     []byte("all:"),
+		"assets/.gitattributes": []byte("*.map export-ignore\n"),
+		"assets/app.js.map":     []byte("{}"),
+	})
+
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, Deploy: "export"})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed exporting repo: %v", err)
+	}
+	publishDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	want := []string{"assets/app.js", "index.html", "old.html"}
+	if diff := cmp.Diff(want, listTestFiles(t, publishDir)); diff != "" {
+		t.Fatalf("unexpected files after export (-want +got):\n%s", diff)
+	}
+
+	upstream.commit("second commit", map[string][]byte{
+		"index.html":    []byte("v2"),
+		"old.html":      nil,
+		"assets/app.js": nil,
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed exporting repo: %v", err)
+	}
+	want = []string{"index.html"}
+	if diff := cmp.Diff(want, listTestFiles(t, publishDir)); diff != "" {
+		t.Fatalf("unexpected files after update (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("v2", readTestFile(t, filepath.Join(publishDir, "index.html"))); diff != "" {
+		t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryUpdatePublish(t *testing.T) {
+	for _, deploy := range []string{"checkout", "export"} {
+		t.Run("test publish with "+deploy+" deployment", func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{
+				"README.md":                []byte("readme"),
+				"sites/docs/public/a.html": []byte("docs"),
+				"sites/blog/dist/b.html":   []byte("blog"),
+				"sites/blog/src/b.md":      []byte("blog"),
+			})
+
+			docsDir := filepath.Join(t.TempDir(), "docs")
+			blogDir := filepath.Join(t.TempDir(), "blog")
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: upstream.bareDir,
+				Deploy:  deploy,
+				Publish: []*PublishConfig{
+					{Source: "sites/docs/public", Destination: docsDir},
+					{Source: "/sites/blog/dist/", Destination: blogDir},
+				},
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+			if diff := cmp.Diff([]string{"a.html"}, listTestFiles(t, docsDir)); diff != "" {
+				t.Fatalf("unexpected docs files (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]string{"b.html"}, listTestFiles(t, blogDir)); diff != "" {
+				t.Fatalf("unexpected blog files (-want +got):\n%s", diff)
+			}
+
+			upstream.commit("second commit", map[string][]byte{
+				"sites/blog/dist/b.html": nil,
+				"sites/blog/dist/c.html": []byte("blog"),
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+			if diff := cmp.Diff([]string{"c.html"}, listTestFiles(t, blogDir)); diff != "" {
+				t.Fatalf("unexpected blog files after update (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdatePublishFailureStatus(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Publish: []*PublishConfig{
+			{Source: "public", Destination: filepath.Join(t.TempDir(), "public")},
+		},
+	})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected publish error")
+	}
+	if r.Status().Error == nil {
+		t.Fatalf("expected publish error recorded in status")
+	}
+}
+
+func TestRepositoryUpdatePublishSymlinkReplacedWithDir(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"site/index.html": []byte("v1")})
+	upstream.symlink("site/a", "../../outside")
+
+	rootDir := t.TempDir()
+	outsideDir := filepath.Join(rootDir, "outside")
+	if err := os.MkdirAll(outsideDir, 0755); err != nil {
+		t.Fatalf("failed creating %s: %v", outsideDir, err)
+	}
+	destDir := filepath.Join(rootDir, "pub", "site")
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Publish: []*PublishConfig{{Source: "site", Destination: destDir}},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo: %v", err)
+	}
+
+	// The symlink is replaced with the directory of the same name.
+	upstream.commit("remove symlink", map[string][]byte{"site/a": nil})
+	upstream.commit("add directory", map[string][]byte{"site/a/file": []byte("v2")})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo: %v", err)
+	}
+	if files := listTestFiles(t, outsideDir); len(files) > 0 {
+		t.Fatalf("unexpected files outside of publish directory: %v", files)
+	}
+	if diff := cmp.Diff("v2", readTestFile(t, filepath.Join(destDir, "a", "file"))); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// fetch fetches the updates from the remote of the repository and prunes
+// the remote-tracking branches, which no longer exist on the remote.
+func (r *Repository) fetch(repo *git.Repository) error {
+	opts := &git.FetchOptions{}
+	if err := configureFetchOptions(r.Config, opts); err != nil {
+		return err
+	}
+	if branch := r.trackedBranch(repo); branch != "" {
+		// Only the tracked branch is fetched.
+		opts.RefSpecs = []config.RefSpec{singleBranchRefSpec(branch)}
+	}
+	if err := repo.Fetch(opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	if !r.Config.Prune {
+		return nil
+	}
+	pruned, err := pruneRemoteBranches(repo, opts)
+	if err != nil {
+		return err
+	}
+	if len(pruned) > 0 {
+		r.logger.Debug(
+			"pruned remote-tracking branches",
+			zap.String("repo_name", r.Config.Name),
+			zap.Strings("pruned_refs", pruned),
+		)
+	}
+	return nil
+}
+
+// trackedBranch returns the branch tracked by the repository, which is the
+// configured branch, or the default branch checked out by the clone.
+func (r *Repository) trackedBranch(repo *git.Repository) string {
+	if r.Config.Branch != "" {
+		return r.Config.Branch
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return ""
+	}
+	return head.Target().Short()
+}
+
+// singleBranchRefSpec fetches the branch into its remote-tracking branch.
+func singleBranchRefSpec(branch string) config.RefSpec {
+	return config.RefSpec("+" + plumbing.NewBranchReferenceName(branch).String() + ":" +
+		plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch).String())
+}
+
+// trackDefaultBranch moves the tip of the default branch, which the
+// single-branch clone without a configured branch stores in
+// refs/remotes/origin/HEAD, to the remote-tracking branch of the branch
+// referenced by HEAD.
+func trackDefaultBranch(repo *git.Repository) error {
+	remoteHead := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, plumbing.HEAD.String())
+	ref, err := repo.Storer.Reference(remoteHead)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	if head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return plumbing.ErrReferenceNotFound
+	}
+	tracking := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, head.Target().Short())
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(tracking, ref.Hash())); err != nil {
+		return err
+	}
+	return repo.Storer.RemoveReference(remoteHead)
+}
+
+// pruneRemoteBranches removes the remote-tracking branches, which no longer
+// exist on the remote.
+func pruneRemoteBranches(repo *git.Repository, fetchOpts *git.FetchOptions) ([]string, error) {
+	remote, err := repo.Remote(fetchOpts.RemoteName)
+	if err != nil {
+		return nil, err
+	}
+	remoteRefs, err := remote.List(&git.ListOptions{Auth: fetchOpts.Auth})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, ref := range remoteRefs {
+		if ref.Name().IsBranch() {
+			found[ref.Name().Short()] = true
+		}
+	}
+
+	localRefs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	prefix := "refs/remotes/" + fetchOpts.RemoteName + "/"
+	var pruned []string
+	err = localRefs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, prefix) || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		if found[strings.TrimPrefix(name, prefix)] {
+			return nil
+		}
+		if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
+			return err
+		}
+		pruned = append(pruned, name)
+		return nil
+	})
+	return pruned, err
+}
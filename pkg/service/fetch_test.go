@@ -0,0 +1,116 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepositoryUpdateShallow(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		deploy string
+	}{
+		{name: "test checkout"},
+		{name: "test export", deploy: "export"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+			upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address:   upstream.bareDir,
+				Branch:    "master",
+				Depth:     1,
+				Deploy:    tc.deploy,
+				CacheSize: 1 << 20,
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			fp := filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+			for _, content := range []string{"v3", "v4"} {
+				upstream.commit("update", map[string][]byte{"index.html": []byte(content)})
+				if err := r.update(); err != nil {
+					t.Fatalf("failed updating shallow repo: %v", err)
+				}
+				if diff := cmp.Diff(content, readTestFile(t, fp)); diff != "" {
+					t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdatePruneNoTags(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	upstream.branch("staging")
+	upstream.branch("docs-next")
+	head, _ := upstream.repo.Head()
+	if _, err := upstream.repo.CreateTag("v1.0.0", head.Hash(), nil); err != nil {
+		t.Fatalf("failed creating tag: %v", err)
+	}
+	upstream.push()
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Prune:   true,
+		NoTags:  true,
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+
+	repo, err := r.openRepository(filepath.Join(r.Config.BaseDir, r.Config.Name))
+	if err != nil {
+		t.Fatalf("failed opening repo: %v", err)
+	}
+	// The remote-tracking branch left by an earlier clone of all branches.
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/remotes/origin/staging", head.Hash())); err != nil {
+		t.Fatalf("failed creating remote-tracking branch: %v", err)
+	}
+
+	upstream.deleteBranch("staging")
+	upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo: %v", err)
+	}
+
+	var got []string
+	refs, _ := repo.References()
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsRemote() || ref.Name().IsTag() {
+			got = append(got, ref.Name().String())
+		}
+		return nil
+	})
+	sort.Strings(got)
+	want := []string{
+		"refs/remotes/origin/master",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected references (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("v2", readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))); diff != "" {
+		t.Fatalf("unexpected content after pull (-want +got):\n%s", diff)
+	}
+}
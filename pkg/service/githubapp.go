@@ -0,0 +1,156 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	githubAPIURL = "https://api.github.com"
+	// githubAppUsername is the username of HTTPS basic auth with the
+	// installation access tokens.
+	githubAppUsername = "x-access-token"
+	// githubAppTokenRefresh is the time before the expiry of the installation
+	// access token, when the token is refreshed.
+	githubAppTokenRefresh = 5 * time.Minute
+	// githubAppJWTLifetime is the lifetime of the JWT of the App, which must
+	// not exceed 10 minutes.
+	githubAppJWTLifetime = 9 * time.Minute
+)
+
+var githubAppClient = &http.Client{Timeout: 30 * time.Second}
+
+// installationToken returns the installation access token of the App
+// requested with the client, or with githubAppClient when the client is
+// nil. The token is cached until shortly before it expires.
+func (gc *GitHubAppConfig) installationToken(client *http.Client) (string, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	now := time.Now()
+	if gc.token != "" && now.Add(githubAppTokenRefresh).Before(gc.expiresAt) {
+		return gc.token, nil
+	}
+
+	jwt, err := gc.signJWT(now)
+	if err != nil {
+		return "", err
+	}
+	apiURL := githubAPIURL
+	if gc.APIURL != "" {
+		apiURL = strings.TrimSuffix(gc.APIURL, "/")
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/app/installations/%d/access_tokens", apiURL, gc.InstallationID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	if client == nil {
+		client = githubAppClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed requesting github app installation token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed requesting github app installation token: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed requesting github app installation token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.Token == "" {
+		return "", fmt.Errorf("malformed github app installation token response: %s", strings.TrimSpace(string(body)))
+	}
+	gc.token = token.Token
+	gc.expiresAt = token.ExpiresAt
+	return gc.token, nil
+}
+
+// signJWT returns the JWT of the App signed with its private key. The key
+// file is read on every call, so that a rotated key is used.
+func (gc *GitHubAppConfig) signJWT(now time.Time) (string, error) {
+	key, err := loadRSAPrivateKey(expandDir(gc.PrivateKeyFile))
+	if err != nil {
+		return "", err
+	}
+	// The issuer is the numeric App ID, or the client ID.
+	var issuer interface{} = gc.AppID
+	if n, err := strconv.ParseInt(gc.AppID, 10, 64); err == nil {
+		issuer = n
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]interface{}{
+		// The issue time is set in the past to allow for clock drift.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+		"iss": issuer,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed signing github app jwt: %v", err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// loadRSAPrivateKey reads PEM encoded RSA private key in PKCS #1 format, as
+// downloaded from GitHub, or in PKCS #8 format.
+func loadRSAPrivateKey(fp string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading github app private key: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("malformed github app private key %s: no PEM data", fp)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("malformed github app private key %s: %v", fp, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("malformed github app private key %s: not an RSA key", fp)
+	}
+	return rsaKey, nil
+}
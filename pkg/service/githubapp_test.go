@@ -0,0 +1,158 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testGitHubAPI issues the installation access tokens for the requests
+// signed with the private key of the App.
+type testGitHubAPI struct {
+	mu sync.Mutex
+	// The lifetime of the issued tokens.
+	lifetime time.Duration
+	tokens   map[string]bool
+	requests int
+}
+
+func (api *testGitHubAPI) ServeHTTP(w http.ResponseWriter, r *http.Request, key *rsa.PublicKey) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v3/app/installations/42/access_tokens" {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+	if len(parts) != 3 {
+		http.Error(w, "malformed jwt", http.StatusUnauthorized)
+		return
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		http.Error(w, "invalid jwt signature", http.StatusUnauthorized)
+		return
+	}
+	var claims struct {
+		Issuer    int64 `json:"iss"`
+		ExpiresAt int64 `json:"exp"`
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Issuer != 123 || claims.ExpiresAt < time.Now().Unix() {
+		http.Error(w, "invalid jwt claims", http.StatusUnauthorized)
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.requests++
+	token := fmt.Sprintf("ghs_%d", api.requests)
+	api.tokens[token] = true
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": time.Now().Add(api.lifetime).UTC().Format(time.RFC3339),
+	})
+}
+
+func TestRepositoryUpdateGitHubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating app key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	keyData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, keyData, 0600); err != nil {
+		t.Fatalf("failed writing app key: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		lifetime time.Duration
+		// The number of token requests after two updates.
+		want int
+	}{
+		{
+			name:     "test cached installation token",
+			lifetime: time.Hour,
+			want:     1,
+		},
+		{
+			name:     "test installation token expiring soon",
+			lifetime: time.Minute,
+			want:     2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &testGitHubAPI{lifetime: tc.lifetime, tokens: make(map[string]bool)}
+			apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				api.ServeHTTP(w, r, &key.PublicKey)
+			}))
+			t.Cleanup(apiServer.Close)
+
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+			server := newTestHTTPServer(t, filepath.Dir(upstream.bareDir), func(r *http.Request) bool {
+				username, password, ok := r.BasicAuth()
+				api.mu.Lock()
+				defer api.mu.Unlock()
+				return ok && username == "x-access-token" && api.tokens[password]
+			})
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: server.URL + "/" + filepath.Base(upstream.bareDir),
+				Auth: &AuthConfig{
+					GitHubApp: &GitHubAppConfig{
+						AppID:          "123",
+						InstallationID: 42,
+						PrivateKeyFile: keyFile,
+						APIURL:         apiServer.URL + "/api/v3",
+					},
+				},
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			upstream.commit("update", map[string][]byte{"index.html": []byte("v2")})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+			got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+			if diff := cmp.Diff("v2", got); diff != "" {
+				t.Fatalf("unexpected content (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.want, api.requests); diff != "" {
+				t.Fatalf("unexpected token requests (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostKeyAuth restricts the host key algorithms to the ones of the trusted
+// host keys, so that the remote presents one of them.
+type hostKeyAuth struct {
+	ssh.AuthMethod
+	algorithms []string
+}
+
+// ClientConfig returns the configuration of SSH client.
+func (a *hostKeyAuth) ClientConfig() (*cryptossh.ClientConfig, error) {
+	cfg, err := a.AuthMethod.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.HostKeyAlgorithms = a.algorithms
+	return cfg, nil
+}
+
+// configureHostKey configures the verification of the host key of the
+// remote. By default, the known hosts files of the user are used.
+func (ac *AuthConfig) configureHostKey(auth ssh.AuthMethod, ep *transport.Endpoint) (ssh.AuthMethod, error) {
+	var cb cryptossh.HostKeyCallback
+	var algorithms []string
+	switch {
+	case ac.StrictHostKeyCheckingDisabled:
+		cb = cryptossh.InsecureIgnoreHostKey()
+	case ac.KnownHosts != "" || len(ac.HostKeys) > 0 || len(ac.HostKeyFingerprints) > 0:
+		var err error
+		if cb, algorithms, err = ac.hostKeyCallback(ep); err != nil {
+			return nil, err
+		}
+	default:
+		return auth, nil
+	}
+
+	helper := ssh.HostKeyCallbackHelper{HostKeyCallback: cb}
+	switch a := auth.(type) {
+	case *ssh.PublicKeys:
+		a.HostKeyCallbackHelper = helper
+	case *ssh.Password:
+		a.HostKeyCallbackHelper = helper
+	case *ssh.PublicKeysCallback:
+		a.HostKeyCallbackHelper = helper
+	}
+	if len(algorithms) == 0 {
+		return auth, nil
+	}
+	return &hostKeyAuth{AuthMethod: auth, algorithms: algorithms}, nil
+}
+
+// hostKeyCallback returns the callback accepting the host keys found in the
+// known hosts file, the pinned host keys, and the host keys having the
+// pinned fingerprints. It also returns the algorithms of the trusted host
+// keys, unless a fingerprint of unknown algorithm is pinned.
+func (ac *AuthConfig) hostKeyCallback(ep *transport.Endpoint) (cryptossh.HostKeyCallback, []string, error) {
+	var pinned []cryptossh.PublicKey
+	for _, s := range ac.HostKeys {
+		key, err := parseHostKey(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		pinned = append(pinned, key)
+	}
+	var knownHosts cryptossh.HostKeyCallback
+	var known []cryptossh.PublicKey
+	if ac.KnownHosts != "" {
+		var err error
+		if knownHosts, err = knownhosts.New(expandDir(ac.KnownHosts)); err != nil {
+			return nil, nil, err
+		}
+		known = lookupKnownHostKeys(knownHosts, endpointHostPort(ep))
+	}
+
+	cb := func(hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+		for _, k := range pinned {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		fingerprint := cryptossh.FingerprintSHA256(key)
+		for _, s := range ac.HostKeyFingerprints {
+			if s == fingerprint {
+				return nil
+			}
+		}
+		if knownHosts != nil {
+			return knownHosts(hostname, remote, key)
+		}
+		return fmt.Errorf("ssh: host key %s %s of %s is not trusted", key.Type(), fingerprint, hostname)
+	}
+
+	if len(ac.HostKeyFingerprints) > 0 {
+		return cb, nil, nil
+	}
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, key := range append(pinned, known...) {
+		for _, algo := range hostKeyAlgorithms(key.Type()) {
+			if !seen[algo] {
+				seen[algo] = true
+				algorithms = append(algorithms, algo)
+			}
+		}
+	}
+	return cb, algorithms, nil
+}
+
+// parseHostKey parses the host key in the "<type> <base64>" format of the
+// known hosts files.
+func parseHostKey(s string) (cryptossh.PublicKey, error) {
+	key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("malformed host key %q: %v", s, err)
+	}
+	return key, nil
+}
+
+// lookupKnownHostKeys returns the keys of the host found in the known hosts
+// file. The callback is probed with a key, which is not known, and returns
+// the known keys in the error.
+func lookupKnownHostKeys(cb cryptossh.HostKeyCallback, hostPort string) []cryptossh.PublicKey {
+	probe, err := cryptossh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := cb(hostPort, &net.TCPAddr{IP: net.IPv4zero}, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var keys []cryptossh.PublicKey
+	for _, k := range keyErr.Want {
+		keys = append(keys, k.Key)
+	}
+	return keys
+}
+
+// hostKeyAlgorithms returns the signature algorithms of the host key type.
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == cryptossh.KeyAlgoRSA {
+		return []string{cryptossh.KeyAlgoRSASHA512, cryptossh.KeyAlgoRSASHA256, cryptossh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// endpointHostPort returns the address of the SSH remote.
+func endpointHostPort(ep *transport.Endpoint) string {
+	if ep == nil {
+		return ""
+	}
+	port := ep.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(ep.Host, strconv.Itoa(port))
+}
+
+// isHostKeyFingerprint checks whether the string is SHA256 fingerprint of
+// a host key, as printed by ssh-keygen -l.
+func isHostKeyFingerprint(s string) bool {
+	return strings.HasPrefix(s, "SHA256:") && len(s) > len("SHA256:")
+}
@@ -0,0 +1,260 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer serves git-upload-pack over SSH as a no-network fixture.
+type testSSHServer struct {
+	addr     string
+	hostKeys []cryptossh.Signer
+}
+
+// newTestSSHServer starts SSH server with RSA and Ed25519 host keys. The
+// clients are authenticated by the server config, or with "git" username
+// and "secret" password, when the config is nil.
+func newTestSSHServer(t *testing.T, cfg *cryptossh.ServerConfig) *testSSHServer {
+	t.Helper()
+	if _, err := exec.LookPath("git-upload-pack"); err != nil {
+		t.Skip("git-upload-pack is not available")
+	}
+	if cfg == nil {
+		cfg = &cryptossh.ServerConfig{
+			PasswordCallback: func(conn cryptossh.ConnMetadata, password []byte) (*cryptossh.Permissions, error) {
+				if conn.User() == "git" && string(password) == "secret" {
+					return nil, nil
+				}
+				return nil, io.EOF
+			},
+		}
+	}
+	s := &testSSHServer{}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating rsa host key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating ed25519 host key: %v", err)
+	}
+	for _, key := range []interface{}{rsaKey, edKey} {
+		signer, err := cryptossh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("failed creating host key signer: %v", err)
+		}
+		cfg.AddHostKey(signer)
+		s.hostKeys = append(s.hostKeys, signer)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc, cfg)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(nc net.Conn, cfg *cryptossh.ServerConfig) {
+	conn, chans, reqs, err := cryptossh.NewServerConn(nc, cfg)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	defer conn.Close()
+	go cryptossh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(cryptossh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				var payload struct{ Command string }
+				if req.Type != "exec" || cryptossh.Unmarshal(req.Payload, &payload) != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				args := strings.SplitN(payload.Command, " ", 2)
+				if len(args) != 2 || args[0] != "git-upload-pack" {
+					ch.SendRequest("exit-status", false, cryptossh.Marshal(struct{ Status uint32 }{1}))
+					return
+				}
+				cmd := exec.Command(args[0], strings.Trim(args[1], "'"))
+				cmd.Stdout = ch
+				cmd.Stderr = ch.Stderr()
+				stdin, err := cmd.StdinPipe()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(stdin, ch)
+					stdin.Close()
+				}()
+				var status uint32
+				if err := cmd.Run(); err != nil {
+					status = 1
+				}
+				ch.SendRequest("exit-status", false, cryptossh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+// url returns the address of the repository served by the server.
+func (s *testSSHServer) url(repoDir string) string {
+	return "ssh://git@" + s.addr + repoDir
+}
+
+func TestRepositoryUpdateHostKey(t *testing.T) {
+	server := newTestSSHServer(t, nil)
+	rsaKey, edKey := server.hostKeys[0].PublicKey(), server.hostKeys[1].PublicKey()
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := cryptossh.NewSignerFromKey(otherKey)
+	authorizedKey := func(key cryptossh.PublicKey) string {
+		return strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(key)))
+	}
+	writeKnownHosts := func(t *testing.T, keys ...cryptossh.PublicKey) string {
+		fp := filepath.Join(t.TempDir(), "known_hosts")
+		var lines []string
+		for _, key := range keys {
+			lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, key))
+		}
+		if err := os.WriteFile(fp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatalf("failed writing known hosts: %v", err)
+		}
+		return fp
+	}
+
+	for _, tc := range []struct {
+		name      string
+		auth      func(t *testing.T) *AuthConfig
+		shouldErr bool
+	}{
+		{
+			name: "test known hosts file",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{KnownHosts: writeKnownHosts(t, edKey)}
+			},
+		},
+		{
+			name: "test known hosts file without host",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{KnownHosts: writeKnownHosts(t)}
+			},
+			shouldErr: true,
+		},
+		{
+			name: "test known hosts file with changed host key",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{KnownHosts: writeKnownHosts(t, otherSigner.PublicKey())}
+			},
+			shouldErr: true,
+		},
+		{
+			name: "test pinned host key",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{HostKeys: []string{authorizedKey(edKey)}}
+			},
+		},
+		{
+			name: "test pinned rsa host key",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{HostKeys: []string{authorizedKey(rsaKey)}}
+			},
+		},
+		{
+			name: "test pinned other host key",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{HostKeys: []string{authorizedKey(otherSigner.PublicKey())}}
+			},
+			shouldErr: true,
+		},
+		{
+			name: "test pinned host key fingerprints",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{HostKeyFingerprints: []string{
+					cryptossh.FingerprintSHA256(rsaKey),
+					cryptossh.FingerprintSHA256(edKey),
+				}}
+			},
+		},
+		{
+			name: "test pinned other host key fingerprint",
+			auth: func(t *testing.T) *AuthConfig {
+				return &AuthConfig{HostKeyFingerprints: []string{cryptossh.FingerprintSHA256(otherSigner.PublicKey())}}
+			},
+			shouldErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+			auth := tc.auth(t)
+			auth.Username = "git"
+			auth.Password = "secret"
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: server.url(upstream.bareDir),
+				Auth:    auth,
+			})
+			err := r.update()
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected host key verification error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+			if diff := cmp.Diff("v1", got); diff != "" {
+				t.Fatalf("unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// installHTTPTransport replaces the HTTP(S) transports of go-git, which are
+// registered for the whole process, with httpTransport once. The installed
+// transport keeps the default client for the authentication without
+// clientAuth, i.e. for the repositories without the TLS and proxy options
+// and for the other users of go-git in the process.
+var installHTTPTransport sync.Once
+
+// httpTransport is the HTTP(S) transport of go-git, which uses the HTTP
+// client of the repository passed along with the authentication. The other
+// repositories use the default client.
+type httpTransport struct {
+	defaultTransport transport.Transport
+}
+
+// clientAuth carries the HTTP client of the repository along with the
+// authentication, which may be nil.
+type clientAuth struct {
+	auth   githttp.AuthMethod
+	client *http.Client
+}
+
+// Name returns the name of the authentication.
+func (a *clientAuth) Name() string {
+	if a.auth == nil {
+		return "http-client"
+	}
+	return a.auth.Name()
+}
+
+// String returns the description of the authentication.
+func (a *clientAuth) String() string {
+	if a.auth == nil {
+		return "http-client"
+	}
+	return a.auth.String()
+}
+
+// NewUploadPackSession starts the session for fetching.
+func (t *httpTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	tr, auth := t.resolve(auth)
+	return tr.NewUploadPackSession(ep, auth)
+}
+
+// NewReceivePackSession starts the session for pushing.
+func (t *httpTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	tr, auth := t.resolve(auth)
+	return tr.NewReceivePackSession(ep, auth)
+}
+
+// resolve returns the transport with the HTTP client of the repository and
+// the authentication it carries.
+func (t *httpTransport) resolve(auth transport.AuthMethod) (transport.Transport, transport.AuthMethod) {
+	a, ok := auth.(*clientAuth)
+	if !ok {
+		return t.defaultTransport, auth
+	}
+	if a.auth == nil {
+		return githttp.NewClient(a.client), nil
+	}
+	return githttp.NewClient(a.client), a.auth
+}
+
+// httpClient returns the HTTP client of the repository configured with the
+// TLS and proxy options, or nil when the default client is used. The client
+// certificate is loaded on every TLS handshake. The CA file is read on every
+// call, and the client is replaced when the CA file changes.
+func (rc *RepositoryConfig) httpClient() (*http.Client, error) {
+	if rc.TLS == nil && rc.Proxy == "" {
+		return nil, nil
+	}
+	var ca []byte
+	if rc.TLS != nil && rc.TLS.CAFile != "" {
+		b, err := os.ReadFile(expandDir(rc.TLS.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading tls ca file: %v", err)
+		}
+		ca = b
+	}
+	rc.clientMu.Lock()
+	defer rc.clientMu.Unlock()
+	if rc.client != nil && bytes.Equal(ca, rc.clientCA) {
+		return rc.client, nil
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if rc.Proxy != "" {
+		proxyURL, err := url.Parse(rc.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	if rc.TLS != nil {
+		tlsCfg := &tls.Config{InsecureSkipVerify: rc.TLS.InsecureSkipVerify}
+		if rc.TLS.CAFile != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("malformed tls ca file %s: no certificates", rc.TLS.CAFile)
+			}
+			tlsCfg.RootCAs = pool
+		}
+		if rc.TLS.ClientCert != "" {
+			certFile, keyFile := expandDir(rc.TLS.ClientCert), expandDir(rc.TLS.ClientKey)
+			if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+				return nil, fmt.Errorf("failed loading tls client certificate: %v", err)
+			}
+			tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+				if err != nil {
+					return nil, err
+				}
+				return &cert, nil
+			}
+		}
+		tr.TLSClientConfig = tlsCfg
+	}
+
+	installHTTPTransport.Do(func() {
+		for _, protocol := range []string{transportHTTP, transportHTTPS} {
+			client.InstallProtocol(protocol, &httpTransport{defaultTransport: githttp.DefaultClient})
+		}
+	})
+	if rc.client != nil {
+		// The connections verified with the replaced CA file are closed.
+		rc.client.CloseIdleConnections()
+	}
+	rc.client = &http.Client{Transport: tr}
+	rc.clientCA = ca
+	return rc.client, nil
+}
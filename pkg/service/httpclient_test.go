@@ -0,0 +1,276 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeTestPEM writes the PEM block into the file in the directory.
+func writeTestPEM(t *testing.T, dir, name, blockType string, b []byte) string {
+	t.Helper()
+	fp := filepath.Join(dir, name)
+	if err := os.WriteFile(fp, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0600); err != nil {
+		t.Fatalf("failed writing %s: %v", name, err)
+	}
+	return fp
+}
+
+func TestRepositoryUpdateTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating client key: %v", err)
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "caddy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, clientTemplate, &clientKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatalf("failed creating client certificate: %v", err)
+	}
+	clientCert, _ := x509.ParseCertificate(clientDER)
+	clientKeyDER, _ := x509.MarshalECPrivateKey(clientKey)
+	clientCertFile := writeTestPEM(t, dir, "client.pem", "CERTIFICATE", clientDER)
+	clientKeyFile := writeTestPEM(t, dir, "client-key.pem", "EC PRIVATE KEY", clientKeyDER)
+
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	server := httptest.NewUnstartedServer(newTestGitHandler(t, filepath.Dir(upstream.bareDir), func(r *http.Request) bool {
+		return true
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	caFile := writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	for _, tc := range []struct {
+		name      string
+		tls       *TLSConfig
+		shouldErr bool
+	}{
+		{
+			name: "test private ca and client certificate",
+			tls:  &TLSConfig{CAFile: caFile, ClientCert: clientCertFile, ClientKey: clientKeyFile},
+		},
+		{
+			name: "test skipped verification and client certificate",
+			tls:  &TLSConfig{InsecureSkipVerify: true, ClientCert: clientCertFile, ClientKey: clientKeyFile},
+		},
+		{
+			name:      "test private ca without client certificate",
+			tls:       &TLSConfig{CAFile: caFile},
+			shouldErr: true,
+		},
+		{
+			name:      "test client certificate without private ca",
+			tls:       &TLSConfig{ClientCert: clientCertFile, ClientKey: clientKeyFile},
+			shouldErr: true,
+		},
+		{
+			name:      "test default client",
+			shouldErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: server.URL + "/" + filepath.Base(upstream.bareDir),
+				TLS:     tc.tls,
+			})
+			err := r.update()
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected tls error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+			if diff := cmp.Diff("v1", got); diff != "" {
+				t.Fatalf("unexpected content (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdateProxy(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	server := newTestHTTPServer(t, filepath.Dir(upstream.bareDir), func(r *http.Request) bool {
+		return r.Header.Get("Via") == "test-proxy"
+	})
+	// The proxy forwards the requests to the server.
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		req.ContentLength = r.ContentLength
+		req.Header = r.Header.Clone()
+		req.Header.Set("Via", "test-proxy")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(proxy.Close)
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: server.URL + "/" + filepath.Base(upstream.bareDir),
+		Proxy:   proxy.URL,
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo via proxy: %v", err)
+	}
+	if atomic.LoadInt32(&proxied) == 0 {
+		t.Fatalf("expected requests sent via proxy")
+	}
+
+	// The other repositories are not affected by the proxy.
+	other := newTestRepository(t, &RepositoryConfig{Address: server.URL + "/" + filepath.Base(upstream.bareDir)})
+	if err := other.update(); err == nil {
+		t.Fatalf("expected error without proxy")
+	}
+}
+
+// newTestServerCertificate creates the self-signed certificate of the test
+// server and writes it into the CA file.
+func newTestServerCertificate(t *testing.T, dir, name string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating server key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed creating server certificate: %v", err)
+	}
+	caFile := writeTestPEM(t, dir, name+".pem", "CERTIFICATE", der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func TestRepositoryUpdateTLSPerRepository(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	var urls, caFiles []string
+	for _, name := range []string{"foo", "bar"} {
+		cert, caFile := newTestServerCertificate(t, dir, name)
+		server := httptest.NewUnstartedServer(newTestGitHandler(t, filepath.Dir(upstream.bareDir), func(r *http.Request) bool {
+			return true
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		urls = append(urls, server.URL+"/"+filepath.Base(upstream.bareDir))
+		caFiles = append(caFiles, caFile)
+	}
+
+	// The repositories use the CA files of their servers at the same time.
+	var repos []*Repository
+	for i := range urls {
+		r := newTestRepository(t, &RepositoryConfig{
+			Name:    fmt.Sprintf("test%d", i),
+			Address: urls[i],
+			TLS:     &TLSConfig{CAFile: caFiles[i]},
+		})
+		if err := r.update(); err != nil {
+			t.Fatalf("failed cloning repo from %s: %v", urls[i], err)
+		}
+		repos = append(repos, r)
+	}
+	for _, r := range repos {
+		got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+		if diff := cmp.Diff("v1", got); diff != "" {
+			t.Fatalf("unexpected content (-want +got):\n%s", diff)
+		}
+	}
+
+	// The CA file is reread, when it is replaced.
+	caFile := filepath.Join(dir, "rotated.pem")
+	b, err := os.ReadFile(caFiles[1])
+	if err != nil {
+		t.Fatalf("failed reading ca file: %v", err)
+	}
+	if err := os.WriteFile(caFile, b, 0600); err != nil {
+		t.Fatalf("failed writing ca file: %v", err)
+	}
+	r := newTestRepository(t, &RepositoryConfig{Address: urls[0], TLS: &TLSConfig{CAFile: caFile}})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected tls error with the ca file of another server")
+	}
+	b, err = os.ReadFile(caFiles[0])
+	if err != nil {
+		t.Fatalf("failed reading ca file: %v", err)
+	}
+	if err := os.WriteFile(caFile, b, 0600); err != nil {
+		t.Fatalf("failed writing ca file: %v", err)
+	}
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo after replacing ca file: %v", err)
+	}
+}
@@ -0,0 +1,509 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	lfsSpecVersion    = "https://git-lfs.github.com/spec/v1"
+	lfsPointerMaxSize = 1024
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	lfsBatchSize      = 100
+)
+
+// lfsPointer is the pointer file stored in git in place of LFS object.
+type lfsPointer struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// lfsBatchRequest is the request of LFS batch API.
+type lfsBatchRequest struct {
+	Operation string        `json:"operation"`
+	Transfers []string      `json:"transfers,omitempty"`
+	Objects   []*lfsPointer `json:"objects"`
+}
+
+// lfsBatchResponse is the response of LFS batch API.
+type lfsBatchResponse struct {
+	Objects []*lfsObject `json:"objects"`
+	Message string       `json:"message,omitempty"`
+}
+
+type lfsObject struct {
+	OID     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions struct {
+		Download *lfsAction `json:"download,omitempty"`
+	} `json:"actions,omitempty"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// lfsStore downloads LFS objects from the LFS server of the Repository and
+// caches them in the lfs directory of the repository metadata.
+type lfsStore struct {
+	dir      string
+	endpoint string
+	cfg      *RepositoryConfig
+	client   *http.Client
+}
+
+// newLFSStore returns the store of LFS objects, or nil when LFS is not
+// enabled for the Repository.
+func (r *Repository) newLFSStore() *lfsStore {
+	if r.Config.LFS == nil {
+		return nil
+	}
+	return &lfsStore{
+		dir:      filepath.Join(r.metadataDir(), "lfs"),
+		endpoint: r.Config.lfsEndpoint(),
+		cfg:      r.Config,
+		client:   http.DefaultClient,
+	}
+}
+
+// lfsEndpoint returns the URL of LFS server. By default, it is derived from
+// the address of the Repository the same way git-lfs does.
+func (rc *RepositoryConfig) lfsEndpoint() string {
+	if rc.LFS.URL != "" {
+		return strings.TrimSuffix(rc.LFS.URL, "/")
+	}
+	var s string
+	switch {
+	case isHTTPTransport(rc.transport):
+		s = strings.TrimSuffix(rc.Address, "/")
+	case isSSHTransport(rc.transport):
+		s = "https://" + rc.endpoint.Host + "/" + strings.TrimPrefix(rc.endpoint.Path, "/")
+	default:
+		return ""
+	}
+	if !strings.HasSuffix(s, ".git") {
+		s += ".git"
+	}
+	return s + "/info/lfs"
+}
+
+// parseLFSPointer parses the file as LFS pointer. It returns nil when the
+// file is not a pointer.
+func parseLFSPointer(f *object.File) *lfsPointer {
+	if f.Size > lfsPointerMaxSize || (f.Mode != filemode.Regular && f.Mode != filemode.Executable) {
+		return nil
+	}
+	content, err := f.Contents()
+	if err != nil || !strings.HasPrefix(content, "version "+lfsSpecVersion+"\n") {
+		return nil
+	}
+	p := &lfsPointer{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		k, v, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			return nil
+		}
+		switch k {
+		case "oid":
+			p.OID = strings.TrimPrefix(v, "sha256:")
+			if p.OID == v || len(p.OID) != sha256.Size*2 {
+				return nil
+			}
+			if _, err := hex.DecodeString(p.OID); err != nil {
+				return nil
+			}
+		case "size":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil
+			}
+			p.Size = n
+		}
+	}
+	if p.OID == "" {
+		return nil
+	}
+	return p
+}
+
+// collectLFSPointers returns the LFS pointers found under the prefix of the
+// tree, keyed by the hash of the pointer blob.
+func collectLFSPointers(tree *object.Tree, prefix string) (map[plumbing.Hash]*lfsPointer, error) {
+	pointers := make(map[plumbing.Hash]*lfsPointer)
+	prefix = strings.Trim(prefix, "/")
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if prefix != "" && !strings.HasPrefix(f.Name, prefix+"/") {
+			return nil
+		}
+		if p := parseLFSPointer(f); p != nil {
+			pointers[f.Hash] = p
+		}
+		return nil
+	})
+	return pointers, err
+}
+
+// objectPath returns the path of the cached LFS object.
+func (s *lfsStore) objectPath(oid string) string {
+	return filepath.Join(s.dir, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// fetch downloads the objects, which are not cached yet.
+func (s *lfsStore) fetch(pointers map[plumbing.Hash]*lfsPointer) error {
+	var missing []*lfsPointer
+	requested := make(map[string]*lfsPointer)
+	for _, p := range pointers {
+		if requested[p.OID] != nil {
+			continue
+		}
+		requested[p.OID] = p
+		if fi, err := os.Stat(s.objectPath(p.OID)); err == nil && fi.Size() == p.Size {
+			continue
+		}
+		missing = append(missing, p)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if s.endpoint == "" {
+		return fmt.Errorf("lfs endpoint is not configured")
+	}
+
+	for i := 0; i < len(missing); i += lfsBatchSize {
+		j := i + lfsBatchSize
+		if j > len(missing) {
+			j = len(missing)
+		}
+		resp, err := s.batch(missing[i:j])
+		if err != nil {
+			return err
+		}
+		for _, obj := range resp.Objects {
+			// The identifier is a part of the cache path, so only the
+			// requested objects are accepted.
+			p, exists := requested[obj.OID]
+			if !exists {
+				return fmt.Errorf("lfs object %q was not requested", obj.OID)
+			}
+			if obj.Error != nil {
+				return fmt.Errorf("lfs object %s: %s (%d)", obj.OID, obj.Error.Message, obj.Error.Code)
+			}
+			if obj.Actions.Download == nil {
+				return fmt.Errorf("lfs object %s has no download action", obj.OID)
+			}
+			if err := s.download(p, obj.Actions.Download); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// batch requests the download actions of the objects.
+func (s *lfsStore) batch(objects []*lfsPointer) (*lfsBatchResponse, error) {
+	b, err := json.Marshal(&lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   objects,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/objects/batch", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if err := s.configureAuth(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	batchResp := &lfsBatchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(batchResp); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("malformed lfs batch response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lfs batch request failed: %s %s", resp.Status, batchResp.Message)
+	}
+	return batchResp, nil
+}
+
+// download downloads the object into the cache and verifies its content.
+func (s *lfsStore) download(p *lfsPointer, action *lfsAction) error {
+	req, err := http.NewRequest(http.MethodGet, action.Href, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs object %s download failed: %s", p.OID, resp.Status)
+	}
+
+	fp := s.objectPath(p.OID)
+	if err := os.MkdirAll(filepath.Dir(fp), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fp), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	// The body is read up to a byte past the size, so that the oversized
+	// object is detected without filling the disk.
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, p.Size+1))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if n != p.Size {
+		return fmt.Errorf("lfs object %s size mismatch, want %d bytes", p.OID, p.Size)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != p.OID {
+		return fmt.Errorf("lfs object %s content mismatch", p.OID)
+	}
+	return os.Rename(tmp.Name(), fp)
+}
+
+// do sends the request with the HTTP client of the Repository, when the
+// TLS or proxy options are configured.
+func (s *lfsStore) do(req *http.Request) (*http.Response, error) {
+	client, err := s.cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = s.client
+	}
+	return client.Do(req)
+}
+
+// configureAuth adds the credentials of the Repository to the request.
+func (s *lfsStore) configureAuth(req *http.Request) error {
+	if s.cfg.authProvider != nil && isHTTPTransport(s.cfg.transport) {
+		auth, err := s.cfg.providedAuth()
+		if err != nil {
+			return err
+		}
+		if httpAuth, ok := auth.(githttp.AuthMethod); ok {
+			httpAuth.SetAuth(req)
+		}
+		return nil
+	}
+	if s.cfg.Auth == nil || !isHTTPTransport(s.cfg.transport) {
+		return nil
+	}
+	client, err := s.cfg.httpClient()
+	if err != nil {
+		return err
+	}
+	ac, err := s.cfg.Auth.loadSecrets(client)
+	if err != nil {
+		return err
+	}
+	switch {
+	case ac.Token != "" && ac.Username == "":
+		req.Header.Set("Authorization", "Bearer "+string(ac.Token))
+	case ac.Token != "":
+		req.SetBasicAuth(ac.Username, string(ac.Token))
+	case ac.Username != "":
+		req.SetBasicAuth(ac.Username, string(ac.Password))
+	}
+	return nil
+}
+
+// writeObject writes the cached object to fp under root, unless the file
+// there has the same content and mode already.
+func (s *lfsStore) writeObject(root, fp string, p *lfsPointer, perm os.FileMode) error {
+	if err := prepareTreeDirs(root, fp); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(fp); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm() == perm && fi.Size() == p.Size {
+		if oid, err := computeFileOID(fp); err == nil && oid == p.OID {
+			return nil
+		}
+	}
+	if err := prepareTreeFile(fp); err != nil {
+		return err
+	}
+	fh, err := os.Open(s.objectPath(p.OID))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return writeFileAtomic(fp, fh, perm)
+}
+
+// smudgeWorktree replaces the LFS pointers in the worktree of the checkout
+// with the content of the objects. The files matching the size of their
+// objects are considered replaced already.
+func (r *Repository) smudgeWorktree(repo *git.Repository, repoDir string) error {
+	s := r.newLFSStore()
+	if s == nil {
+		return nil
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	pointers, err := collectLFSPointers(tree, "")
+	if err != nil || len(pointers) == 0 {
+		return err
+	}
+	if err := s.fetch(pointers); err != nil {
+		return err
+	}
+
+	var count int
+	err = tree.Files().ForEach(func(f *object.File) error {
+		p, exists := pointers[f.Hash]
+		if !exists {
+			return nil
+		}
+		fp := filepath.Join(repoDir, filepath.FromSlash(f.Name))
+		if fi, err := os.Lstat(fp); err == nil && fi.Size() == p.Size && p.Size != f.Size {
+			return nil
+		}
+		count++
+		return s.writeObject(repoDir, fp, p, treeFilePerm(f))
+	})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		r.logger.Debug(
+			"replaced lfs pointers",
+			zap.String("repo_name", r.Config.Name),
+			zap.Int("count", count),
+		)
+	}
+	return nil
+}
+
+// checkoutTree applies the changes between the old tree and the tree of the
+// commit to the worktree in repoDir. The LFS pointers are written as the
+// content of the objects.
+func (r *Repository) checkoutTree(repoDir string, oldTree *object.Tree, commit *object.Commit) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	s := r.newLFSStore()
+	pointers, err := collectLFSPointers(tree, "")
+	if err != nil {
+		return err
+	}
+	if err := s.fetch(pointers); err != nil {
+		return err
+	}
+	changes, err := object.DiffTree(oldTree, tree)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return err
+		}
+		if action == merkletrie.Delete {
+			fp := filepath.Join(repoDir, filepath.FromSlash(change.From.Name))
+			if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		f, err := tree.File(change.To.Name)
+		if err != nil {
+			if err == object.ErrFileNotFound {
+				// The submodules are not checked out.
+				continue
+			}
+			return err
+		}
+		fp := filepath.Join(repoDir, filepath.FromSlash(f.Name))
+		if p, exists := pointers[f.Hash]; exists {
+			err = s.writeObject(repoDir, fp, p, treeFilePerm(f))
+		} else {
+			err = writeTreeFile(repoDir, fp, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// computeFileOID computes the LFS object identifier of the file.
+func computeFileOID(fp string) (string, error) {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testLFSServer is a stand-in for LFS server serving the batch API and
+// the basic transfer downloads.
+type testLFSServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	objects   map[string][]byte
+	downloads int
+}
+
+func newTestLFSServer(t *testing.T) *testLFSServer {
+	t.Helper()
+	s := &testLFSServer{objects: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		req := &lfsBatchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Operation != "download" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := &lfsBatchResponse{}
+		for _, p := range req.Objects {
+			obj := &lfsObject{OID: p.OID, Size: p.Size}
+			obj.Actions.Download = &lfsAction{
+				Href:   s.URL + "/download/" + p.OID,
+				Header: map[string]string{"X-Test-Token": "foobar"},
+			}
+			resp.Objects = append(resp.Objects, obj)
+		}
+		w.Header().Set("Content-Type", lfsMediaType)
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		content, exists := s.objects[strings.TrimPrefix(r.URL.Path, "/download/")]
+		if !exists || r.Header.Get("X-Test-Token") != "foobar" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.downloads++
+		w.Write(content)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// add stores the content on the server and returns its pointer file.
+func (s *testLFSServer) add(content []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	s.objects[oid] = content
+	return []byte(fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsSpecVersion, oid, len(content)))
+}
+
+func TestRepositoryUpdateLFS(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		deploy string
+	}{
+		{name: "test checkout"},
+		{name: "test export", deploy: "export"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestLFSServer(t)
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{
+				"index.html":       []byte("v1"),
+				"images/logo.png":  server.add([]byte("logo v1")),
+				"videos/intro.mp4": server.add([]byte("intro v1")),
+			})
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: upstream.bareDir,
+				Branch:  "master",
+				Deploy:  tc.deploy,
+				LFS:     &LFSConfig{URL: server.URL},
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+			for name, want := range map[string]string{
+				"index.html":       "v1",
+				"images/logo.png":  "logo v1",
+				"videos/intro.mp4": "intro v1",
+			} {
+				if diff := cmp.Diff(want, readTestFile(t, filepath.Join(repoDir, name))); diff != "" {
+					t.Fatalf("unexpected %s content after clone (-want +got):\n%s", name, diff)
+				}
+			}
+
+			upstream.commit("update logo", map[string][]byte{
+				"images/logo.png": server.add([]byte("logo v2")),
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+			if diff := cmp.Diff("logo v2", readTestFile(t, filepath.Join(repoDir, "images/logo.png"))); diff != "" {
+				t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("intro v1", readTestFile(t, filepath.Join(repoDir, "videos/intro.mp4"))); diff != "" {
+				t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+			}
+
+			// The objects are downloaded once and cached.
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+			if diff := cmp.Diff(3, server.downloads); diff != "" {
+				t.Fatalf("unexpected downloads (-want +got):\n%s", diff)
+			}
+			entries, _ := filepath.Glob(filepath.Join(r.metadataDir(), "lfs", "objects", "*", "*", "*"))
+			if diff := cmp.Diff(3, len(entries)); diff != "" {
+				t.Fatalf("unexpected cached objects (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdateLFSMissingObject(t *testing.T) {
+	server := newTestLFSServer(t)
+	upstream := newTestUpstream(t)
+	pointer := server.add([]byte("logo v1"))
+	server.objects = make(map[string][]byte)
+	upstream.commit("initial commit", map[string][]byte{"images/logo.png": pointer})
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Deploy:  "export",
+		LFS:     &LFSConfig{URL: server.URL},
+	})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected update to fail")
+	}
+	if _, err := os.Stat(filepath.Join(r.Config.BaseDir, r.Config.Name, "images", "logo.png")); !os.IsNotExist(err) {
+		t.Fatalf("expected pointer not to be exported, got: %v", err)
+	}
+}
+
+func TestRepositoryUpdateLFSOversizedObject(t *testing.T) {
+	server := newTestLFSServer(t)
+	upstream := newTestUpstream(t)
+	content := []byte("logo v1")
+	pointer := server.add(content)
+	for oid := range server.objects {
+		server.objects[oid] = append(content, make([]byte, 1<<20)...)
+	}
+	upstream.commit("initial commit", map[string][]byte{"images/logo.png": pointer})
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Deploy:  "export",
+		LFS:     &LFSConfig{URL: server.URL},
+	})
+	err := r.update()
+	if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Fatalf("expected size mismatch error, got: %v", err)
+	}
+	entries, _ := filepath.Glob(filepath.Join(r.metadataDir(), "lfs", "objects", "*", "*", "*"))
+	if len(entries) > 0 {
+		t.Fatalf("expected oversized object not to be cached, got: %v", entries)
+	}
+}
+
+func TestLFSEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		address string
+		url     string
+		want    string
+	}{
+		{
+			name:    "test https address",
+			address: "https://github.com/authp/authp.github.io.git",
+			want:    "https://github.com/authp/authp.github.io.git/info/lfs",
+		},
+		{
+			name:    "test https address without git suffix",
+			address: "https://gitea.local/authp/authp.github.io",
+			want:    "https://gitea.local/authp/authp.github.io.git/info/lfs",
+		},
+		{
+			name:    "test scp-like address",
+			address: "git@github.com:authp/authp.github.io.git",
+			want:    "https://github.com/authp/authp.github.io.git/info/lfs",
+		},
+		{
+			name:    "test configured url",
+			address: "/srv/mirrors/authp.github.io",
+			url:     "https://lfs.local/authp/",
+			want:    "https://lfs.local/authp",
+		},
+		{
+			name:    "test local path address",
+			address: "/srv/mirrors/authp.github.io",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := &RepositoryConfig{Address: tc.address, LFS: &LFSConfig{URL: tc.url}}
+			rc.transport, rc.endpoint, _ = parseAddress(rc.Address)
+			if diff := cmp.Diff(tc.want, rc.lfsEndpoint()); diff != "" {
+				t.Fatalf("unexpected endpoint (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
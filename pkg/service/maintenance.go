@@ -0,0 +1,363 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"go.uber.org/zap"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// packWindow is the number of objects considered for delta compression.
+const packWindow = 10
+
+// runMaintenance collapses the shallow history back to the configured
+// depth, repacks the objects reachable from the references into a single
+// packfile, and removes the old packfiles and the loose objects. The go-git
+// repack and prune are not used, because they fail on shallow clones.
+func (r *Repository) runMaintenance() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	gitDir := r.metadataDir()
+	sizeBefore, err := dirSize(gitDir)
+	if err != nil {
+		return err
+	}
+	repo, err := r.openBare(gitDir)
+	if err != nil {
+		return err
+	}
+
+	tips, err := listReferenceTips(repo)
+	if err != nil {
+		return err
+	}
+	shallow, err := loadShallow(repo)
+	if err != nil {
+		return err
+	}
+	if r.Config.Depth > 0 {
+		if shallow, err = collapseShallow(repo, tips, shallow, r.Config.Depth); err != nil {
+			return err
+		}
+	}
+	reachable, err := walkReachable(repo, tips, shallow)
+	if err != nil {
+		return err
+	}
+	if err := repackObjects(repo, reachable); err != nil {
+		return err
+	}
+	var shallowCommits []plumbing.Hash
+	for h := range shallow {
+		if reachable[h] {
+			shallowCommits = append(shallowCommits, h)
+		}
+	}
+	if err := repo.Storer.SetShallow(shallowCommits); err != nil {
+		return err
+	}
+
+	sizeAfter, err := dirSize(gitDir)
+	if err != nil {
+		return err
+	}
+	reclaimed := sizeBefore - sizeAfter
+	if reclaimed < 0 {
+		reclaimed = 0
+	}
+	r.setMaintained(sizeAfter, reclaimed)
+	repositoryDiskBytes.WithLabelValues(r.Config.Name).Set(float64(sizeAfter))
+	maintenanceReclaimedBytes.WithLabelValues(r.Config.Name).Add(float64(reclaimed))
+
+	r.logger.Debug(
+		"maintained repo",
+		zap.String("repo_name", r.Config.Name),
+		zap.Int("objects", len(reachable)),
+		zap.Int("shallow_commits", len(shallowCommits)),
+		zap.Int64("disk_bytes", sizeAfter),
+		zap.Int64("reclaimed_bytes", reclaimed),
+	)
+	return nil
+}
+
+// listReferenceTips returns the objects referenced by the references of
+// the repository.
+func listReferenceTips(repo *git.Repository) ([]plumbing.Hash, error) {
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var tips []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			tips = append(tips, ref.Hash())
+		}
+		return nil
+	})
+	return tips, err
+}
+
+func loadShallow(repo *git.Repository) (map[plumbing.Hash]bool, error) {
+	commits, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+	shallow := make(map[plumbing.Hash]bool)
+	for _, h := range commits {
+		shallow[h] = true
+	}
+	return shallow, nil
+}
+
+// collapseShallow returns the shallow commits of the history truncated to
+// the depth, counting from the tips of the references.
+func collapseShallow(repo *git.Repository, tips []plumbing.Hash, shallow map[plumbing.Hash]bool, depth int) (map[plumbing.Hash]bool, error) {
+	collapsed := make(map[plumbing.Hash]bool)
+	distance := make(map[plumbing.Hash]int)
+	var queue []*object.Commit
+	for _, h := range tips {
+		c, err := peelCommit(repo, h)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			continue
+		}
+		if _, seen := distance[c.Hash]; !seen {
+			distance[c.Hash] = 0
+			queue = append(queue, c)
+		}
+	}
+	// The breadth-first walk visits the commits at the shortest distance
+	// from any of the tips first.
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c.NumParents() == 0 {
+			continue
+		}
+		if shallow[c.Hash] || distance[c.Hash] >= depth-1 {
+			collapsed[c.Hash] = true
+			continue
+		}
+		for _, h := range c.ParentHashes {
+			if _, seen := distance[h]; seen {
+				continue
+			}
+			parent, err := repo.CommitObject(h)
+			if err == plumbing.ErrObjectNotFound {
+				collapsed[c.Hash] = true
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			distance[h] = distance[c.Hash] + 1
+			queue = append(queue, parent)
+		}
+	}
+	return collapsed, nil
+}
+
+// peelCommit returns the commit referenced directly or via tags. It returns
+// nil when the object is not a commit.
+func peelCommit(repo *git.Repository, h plumbing.Hash) (*object.Commit, error) {
+	for {
+		obj, err := repo.Object(plumbing.AnyObject, h)
+		if err == plumbing.ErrObjectNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o, nil
+		case *object.Tag:
+			h = o.Target
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// walkReachable returns the objects reachable from the tips. The parents
+// of the shallow commits are not walked.
+func walkReachable(repo *git.Repository, tips []plumbing.Hash, shallow map[plumbing.Hash]bool) (map[plumbing.Hash]bool, error) {
+	seen := make(map[plumbing.Hash]bool)
+	stack := append([]plumbing.Hash{}, tips...)
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen[h] = true
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, c.TreeHash)
+			if !shallow[h] {
+				stack = append(stack, c.ParentHashes...)
+			}
+		case plumbing.TreeObject:
+			t, err := object.DecodeTree(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range t.Entries {
+				switch entry.Mode {
+				case filemode.Submodule:
+				case filemode.Dir:
+					stack = append(stack, entry.Hash)
+				default:
+					seen[entry.Hash] = true
+				}
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, t.Target)
+		}
+	}
+	return seen, nil
+}
+
+// repackObjects writes the objects into a new packfile, then removes the
+// old packfiles and the loose objects.
+func repackObjects(repo *git.Repository, objects map[plumbing.Hash]bool) error {
+	pos, ok := repo.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return git.ErrPackedObjectsNotSupported
+	}
+	los, ok := repo.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return git.ErrLooseObjectsNotSupported
+	}
+	pfw, ok := repo.Storer.(storer.PackfileWriter)
+	if !ok {
+		return fmt.Errorf("repository storage does not support packfile writes")
+	}
+	oldPacks, err := pos.ObjectPacks()
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(objects))
+	for h := range objects {
+		hashes = append(hashes, h)
+	}
+	wc, err := pfw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+	newPack, err := packfile.NewEncoder(wc, repo.Storer, false).Encode(hashes, packWindow)
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+
+	for _, h := range oldPacks {
+		if h == newPack {
+			continue
+		}
+		if err := pos.DeleteOldObjectPackAndIndex(h, time.Time{}); err != nil {
+			return err
+		}
+	}
+	var loose []plumbing.Hash
+	if err := los.ForEachObjectHash(func(h plumbing.Hash) error {
+		loose = append(loose, h)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, h := range loose {
+		if err := los.DeleteLooseObject(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirSize returns the total size of the files in the directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func maintainer(r *Repository) {
+	r.logger.Debug(
+		"maintenance enabled",
+		zap.String("repo_name", r.Config.Name),
+		zap.Int("interval", r.Config.MaintenanceInterval),
+	)
+	intervals := time.NewTicker(time.Second * time.Duration(r.Config.MaintenanceInterval))
+	defer intervals.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-intervals.C:
+		}
+		if err := r.runMaintenance(); err != nil {
+			maintenanceRuns.WithLabelValues(r.Config.Name, "error").Inc()
+			r.logger.Error("failed maintaining repo", zap.String("repo_name", r.Config.Name), zap.Error(err))
+			continue
+		}
+		maintenanceRuns.WithLabelValues(r.Config.Name, "ok").Inc()
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepositoryMaintenance(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		depth  int
+		deploy string
+		// The number of the latest upstream commits expected to be kept.
+		wantCommits int
+	}{
+		{name: "test full clone", wantCommits: 5},
+		{name: "test shallow clone", depth: 1, wantCommits: 1},
+		{name: "test shallow clone with depth 2", depth: 2, wantCommits: 2},
+		{name: "test shallow export", depth: 1, deploy: "export", wantCommits: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: upstream.bareDir,
+				Branch:  "master",
+				Depth:   tc.depth,
+				Deploy:  tc.deploy,
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+
+			hashes := []plumbing.Hash{}
+			head, _ := upstream.repo.Head()
+			hashes = append(hashes, head.Hash())
+			for i := 2; i <= 5; i++ {
+				upstream.commit("update", map[string][]byte{"index.html": []byte(fmt.Sprintf("v%d", i))})
+				head, _ := upstream.repo.Head()
+				hashes = append(hashes, head.Hash())
+				if err := r.update(); err != nil {
+					t.Fatalf("failed updating repo: %v", err)
+				}
+			}
+
+			repo, err := r.openBare(r.metadataDir())
+			if err != nil {
+				t.Fatalf("failed opening repo: %v", err)
+			}
+			// The unreachable object is pruned.
+			obj := repo.Storer.NewEncodedObject()
+			obj.SetType(plumbing.BlobObject)
+			w, _ := obj.Writer()
+			w.Write([]byte("unreachable"))
+			w.Close()
+			unreachable, err := repo.Storer.SetEncodedObject(obj)
+			if err != nil {
+				t.Fatalf("failed writing object: %v", err)
+			}
+
+			if err := r.runMaintenance(); err != nil {
+				t.Fatalf("failed maintaining repo: %v", err)
+			}
+
+			repo, err = r.openBare(r.metadataDir())
+			if err != nil {
+				t.Fatalf("failed opening repo: %v", err)
+			}
+			var got []bool
+			var want []bool
+			for i, h := range hashes {
+				_, err := repo.CommitObject(h)
+				got = append(got, err == nil)
+				want = append(want, i >= len(hashes)-tc.wantCommits)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("unexpected kept commits (-want +got):\n%s", diff)
+			}
+			if _, err := repo.Storer.EncodedObject(plumbing.AnyObject, unreachable); err != plumbing.ErrObjectNotFound {
+				t.Fatalf("expected unreachable object to be pruned, got: %v", err)
+			}
+			packs, _ := filepath.Glob(filepath.Join(r.metadataDir(), "objects", "pack", "*.pack"))
+			if diff := cmp.Diff(1, len(packs)); diff != "" {
+				t.Fatalf("unexpected packfiles (-want +got):\n%s", diff)
+			}
+			status := r.Status()
+			if status.MaintainedAt.IsZero() || status.DiskBytes == 0 || status.ReclaimedBytes == 0 {
+				t.Fatalf("unexpected status: %+v", status)
+			}
+
+			// The repository keeps updating after the maintenance.
+			upstream.commit("update", map[string][]byte{"index.html": []byte("v6")})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo after maintenance: %v", err)
+			}
+			fp := filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+			if diff := cmp.Diff("v6", readTestFile(t, fp)); diff != "" {
+				t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
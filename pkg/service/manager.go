@@ -16,6 +16,7 @@ package service
 
 import (
 	"go.uber.org/zap"
+	"sort"
 	"sync"
 )
 
@@ -36,21 +37,49 @@ func NewManager(cfg *Config, logger *zap.Logger) (*Manager, error) {
 		logger: logger,
 	}
 	manager = m
+	if err := validatePublishDirs(cfg.Repositories); err != nil {
+		return nil, err
+	}
 	for _, rc := range cfg.Repositories {
 		if err := rc.validate(); err != nil {
+			m.Stop()
 			return nil, err
 		}
 		r, _ := NewRepository(rc)
 		r.logger = logger
+		r.storage = cfg.storage
 		m.repos[rc.Name] = r
 		if err := r.update(); err != nil {
-			m.logger.Error("failed managing repo", zap.String("repo_name", rc.Name), zap.Error(err))
-			return nil, err
+			if !r.awaitDeployKey(err) {
+				m.logger.Error("failed managing repo", zap.String("repo_name", rc.Name), zap.Error(err))
+				m.Stop()
+				return nil, err
+			}
+			// The generated deploy key is not added to the remote yet.
+			m.logger.Warn(
+				"waiting for deploy key, add it to the deploy keys of the repository",
+				zap.String("repo_name", rc.Name),
+				zap.String("public_key", r.Status().DeployKey),
+				zap.Error(err),
+			)
+			if rc.UpdateInterval == 0 {
+				go deployKeyUpdater(r)
+			}
+		} else {
+			m.logger.Debug("registered and synced repo", zap.String("repo_name", rc.Name))
 		}
-		m.logger.Debug("registered and synced repo", zap.String("repo_name", rc.Name))
 		if rc.UpdateInterval > 0 {
 			go autoUpdater(r)
 		}
+		if rc.Preview != nil && rc.Preview.TTL > 0 {
+			go previewCollector(r)
+		}
+		if rc.MaintenanceInterval > 0 {
+			go maintainer(r)
+		}
+		if rc.VerifyInterval > 0 {
+			go verifier(r)
+		}
 	}
 	return m, nil
 }
@@ -62,9 +91,54 @@ func (m *Manager) Start() []*Status {
 	return nil
 }
 
-// Stop stops Manager.
+// Status returns the last recorded status of the managed repositories.
+func (m *Manager) Status() []*Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var statuses []*Status
+	for _, r := range m.repos {
+		statuses = append(statuses, r.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Repository < statuses[j].Repository
+	})
+	return statuses
+}
+
+// Stop stops Manager and the background loops of its repositories.
 func (m *Manager) Stop() []*Status {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	for _, r := range m.repos {
+		r.stop()
+	}
 	return nil
 }
+
+// Statuses returns the last recorded status of the managed repositories.
+func Statuses() []*Status {
+	if manager == nil {
+		return nil
+	}
+	return manager.Status()
+}
+
+// DeployKeys returns the public deploy keys generated for the managed
+// repositories.
+func DeployKeys() []*DeployKey {
+	if manager == nil {
+		return nil
+	}
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	var keys []*DeployKey
+	for _, r := range manager.repos {
+		if key := r.DeployKey(); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Repository < keys[j].Repository
+	})
+	return keys
+}
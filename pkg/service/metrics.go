@@ -0,0 +1,57 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "git"
+)
+
+// The metrics are registered with the default registry, which is exposed by
+// the metrics handler of Caddy.
+var (
+	maintenanceRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "maintenance_runs_total",
+		Help:      "Counter of repository maintenance runs by result.",
+	}, []string{"repo", "result"})
+
+	maintenanceReclaimedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "maintenance_reclaimed_bytes_total",
+		Help:      "Counter of disk space in bytes reclaimed by repository maintenance.",
+	}, []string{"repo"})
+
+	repositoryDiskBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "repository_disk_bytes",
+		Help:      "Disk space in bytes used by repository metadata after the last maintenance.",
+	}, []string{"repo"})
+
+	tamperEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "tamper_events_total",
+		Help:      "Counter of worktree verifications finding changes to the deployed files.",
+	}, []string{"repo"})
+)
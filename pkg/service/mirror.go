@@ -0,0 +1,112 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+)
+
+// mirrorRefSpec fetches all references of the remote as-is.
+const mirrorRefSpec config.RefSpec = "+refs/*:refs/*"
+
+// runMirrorUpdate keeps a bare mirror of the remote repository in repoDir.
+// All branches and tags are fetched, and the references deleted on the
+// remote are pruned.
+func (r *Repository) runMirrorUpdate(repoDir string) error {
+	repoDirExists, err := dirExists(repoDir)
+	if err != nil {
+		return err
+	}
+	if !repoDirExists {
+		opts := &git.CloneOptions{}
+		if err := configureCloneOptions(r.Config, opts); err != nil {
+			return err
+		}
+		opts.Mirror = true
+		if _, err := r.cloneBare(repoDir, opts); err != nil {
+			return err
+		}
+		r.logger.Debug(
+			"cloned mirror repo",
+			zap.String("repo_name", r.Config.Name),
+		)
+		return nil
+	}
+
+	repo, err := r.openBare(repoDir)
+	if err != nil {
+		return err
+	}
+
+	opts := &git.FetchOptions{}
+	if err := configureFetchOptions(r.Config, opts); err != nil {
+		return err
+	}
+	opts.RefSpecs = []config.RefSpec{mirrorRefSpec}
+	opts.Tags = git.AllTags
+	opts.Force = true
+	if err := repo.Fetch(opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	pruned, err := pruneMirrorReferences(repo, opts)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Debug(
+		"fetched mirror repo",
+		zap.String("repo_name", r.Config.Name),
+		zap.Strings("pruned_refs", pruned),
+	)
+	return nil
+}
+
+// pruneMirrorReferences removes the local references which no longer
+// exist on the remote.
+func pruneMirrorReferences(repo *git.Repository, fetchOpts *git.FetchOptions) ([]string, error) {
+	remote, err := repo.Remote(fetchOpts.RemoteName)
+	if err != nil {
+		return nil, err
+	}
+	remoteRefs, err := remote.List(&git.ListOptions{Auth: fetchOpts.Auth})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range remoteRefs {
+		found[ref.Name()] = true
+	}
+
+	localRefs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	err = localRefs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() == plumbing.HEAD || found[ref.Name()] {
+			return nil
+		}
+		if err := repo.Storer.RemoveReference(ref.Name()); err != nil {
+			return err
+		}
+		pruned = append(pruned, ref.Name().String())
+		return nil
+	})
+	return pruned, err
+}
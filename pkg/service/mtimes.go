@@ -0,0 +1,227 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// deployedHead returns the commit deployed by the previous update, or the
+// zero hash when the repository has not been cloned yet.
+func (r *Repository) deployedHead() plumbing.Hash {
+	gitDir := r.metadataDir()
+	if exists, err := dirExists(gitDir); err != nil || !exists {
+		return plumbing.ZeroHash
+	}
+	repo, err := r.openBare(gitDir)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return ref.Hash()
+}
+
+// runCommitTimes sets the modification times of the files deployed by the
+// update from the old commit.
+func (r *Repository) runCommitTimes(old plumbing.Hash) error {
+	repo, err := r.openBare(r.metadataDir())
+	if err != nil {
+		return err
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	if ref.Hash() == old {
+		return nil
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+	repoDir := filepath.Join(expandDir(r.Config.BaseDir), r.Config.Name)
+	if err := r.applyCommitTimes(repo, old, commit, "", repoDir); err != nil {
+		return err
+	}
+	for _, entry := range r.Config.Publish {
+		src := path.Clean(strings.Trim(entry.Source, "/"))
+		if src == "." {
+			src = ""
+		}
+		if err := r.applyCommitTimes(repo, old, commit, src, expandDir(entry.Destination)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyCommitTimes sets the modification times of the files of the commit
+// changed since the old commit, or of all files when the old commit is
+// zero, to the committer time of the last commit changing them. The files
+// of the prefix directory of the tree are deployed into destDir.
+func (r *Repository) applyCommitTimes(repo *git.Repository, old plumbing.Hash, commit *object.Commit, prefix, destDir string) error {
+	paths, err := listChangedPaths(repo, old, commit, prefix)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	times, err := lastCommitTimes(repo, old, commit, paths)
+	if err != nil {
+		return err
+	}
+	for name, t := range times {
+		if prefix != "" {
+			name = strings.TrimPrefix(name, prefix+"/")
+		}
+		fp := filepath.Join(destDir, filepath.FromSlash(name))
+		// The symlinks are skipped, because their targets would be changed.
+		if fi, err := os.Lstat(fp); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Chtimes(fp, t, t); err != nil {
+			return err
+		}
+	}
+	r.logger.Debug(
+		"set file modification times",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("path", destDir),
+		zap.Int("count", len(times)),
+	)
+	return nil
+}
+
+// listChangedPaths returns the paths of the files in the prefix directory
+// of the commit tree added or modified since the old commit.
+func listChangedPaths(repo *git.Repository, old plumbing.Hash, commit *object.Commit, prefix string) (map[string]bool, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	inPrefix := func(name string) bool {
+		return prefix == "" || strings.HasPrefix(name, prefix+"/")
+	}
+	paths := make(map[string]bool)
+
+	var oldTree *object.Tree
+	if !old.IsZero() {
+		if oldCommit, err := repo.CommitObject(old); err == nil {
+			oldTree, _ = oldCommit.Tree()
+		}
+	}
+	if oldTree == nil {
+		err := tree.Files().ForEach(func(f *object.File) error {
+			if inPrefix(f.Name) {
+				paths[f.Name] = true
+			}
+			return nil
+		})
+		return paths, err
+	}
+
+	changes, err := object.DiffTree(oldTree, tree)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if name := change.To.Name; name != "" && inPrefix(name) {
+			paths[name] = true
+		}
+	}
+	return paths, nil
+}
+
+// lastCommitTimes returns the committer time of the last commit changing
+// each of the paths. The commits are walked from the newest one, until the
+// old commit. The first commit of the history, or of the shallow history,
+// accounts for the files it contains.
+func lastCommitTimes(repo *git.Repository, old plumbing.Hash, commit *object.Commit, paths map[string]bool) (map[string]time.Time, error) {
+	remaining := make(map[string]bool, len(paths))
+	for name := range paths {
+		remaining[name] = true
+	}
+	times := make(map[string]time.Time, len(paths))
+	seen := map[plumbing.Hash]bool{old: true, commit.Hash: true}
+	queue := []*object.Commit{commit}
+	for len(queue) > 0 && len(remaining) > 0 {
+		// The newest commit is visited first.
+		next := 0
+		for i, c := range queue {
+			if c.Committer.When.After(queue[next].Committer.When) {
+				next = i
+			}
+		}
+		c := queue[next]
+		queue = append(queue[:next], queue[next+1:]...)
+
+		tree, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+		var parentTree *object.Tree
+		for i, h := range c.ParentHashes {
+			parent, err := repo.CommitObject(h)
+			if err == plumbing.ErrObjectNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				if parentTree, err = parent.Tree(); err != nil {
+					return nil, err
+				}
+			}
+			if !seen[h] {
+				seen[h] = true
+				queue = append(queue, parent)
+			}
+		}
+
+		if parentTree == nil {
+			for name := range remaining {
+				if _, err := tree.File(name); err == nil {
+					times[name] = c.Committer.When
+					delete(remaining, name)
+				}
+			}
+			continue
+		}
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			if name := change.To.Name; remaining[name] {
+				times[name] = c.Committer.When
+				delete(remaining, name)
+			}
+		}
+	}
+	for name := range remaining {
+		times[name] = commit.Committer.When
+	}
+	return times, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepositoryUpdateCommitMtimes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		deploy  string
+		publish bool
+	}{
+		{name: "test checkout"},
+		{name: "test export", deploy: "export"},
+		{name: "test publish", publish: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			day := func(n int) time.Time {
+				return time.Date(2022, time.March, n, 12, 0, 0, 0, time.UTC)
+			}
+			upstream := newTestUpstream(t)
+			upstream.when = day(1)
+			upstream.commit("initial commit", map[string][]byte{
+				"site/index.html": []byte("v1"),
+				"site/about.html": []byte("v1"),
+				"README.md":       []byte("v1"),
+			})
+			upstream.when = day(2)
+			upstream.commit("update about", map[string][]byte{"site/about.html": []byte("v2")})
+
+			rc := &RepositoryConfig{
+				Address:      upstream.bareDir,
+				Deploy:       tc.deploy,
+				CommitMtimes: true,
+			}
+			destDir := filepath.Join(t.TempDir(), "public")
+			if tc.publish {
+				rc.Publish = []*PublishConfig{{Source: "site", Destination: destDir}}
+			}
+			r := newTestRepository(t, rc)
+			if !tc.publish {
+				destDir = filepath.Join(r.Config.BaseDir, r.Config.Name, "site")
+			}
+			mtimes := func() map[string]time.Time {
+				got := make(map[string]time.Time)
+				for _, name := range []string{"index.html", "about.html"} {
+					fi, err := os.Stat(filepath.Join(destDir, name))
+					if err != nil {
+						t.Fatalf("failed reading %s: %v", name, err)
+					}
+					got[name] = fi.ModTime().UTC()
+				}
+				return got
+			}
+
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			want := map[string]time.Time{"index.html": day(1), "about.html": day(2)}
+			if diff := cmp.Diff(want, mtimes()); diff != "" {
+				t.Fatalf("unexpected mtimes after clone (-want +got):\n%s", diff)
+			}
+
+			upstream.when = day(3)
+			upstream.commit("update index", map[string][]byte{"site/index.html": []byte("v3")})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+			want = map[string]time.Time{"index.html": day(3), "about.html": day(2)}
+			if diff := cmp.Diff(want, mtimes()); diff != "" {
+				t.Fatalf("unexpected mtimes after update (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
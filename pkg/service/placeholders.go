@@ -0,0 +1,51 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+// Placeholders returns the placeholders describing the directories of the
+// managed repositories:
+//
+//   - git.repo.<name>.path: the directory of the repository
+//   - git.repo.<name>.branch.<branch>.path: the directory of the branch
+//   - git.repo.<name>.previews.path: the directory of the previews
+//   - git.repo.<name>.preview.id: the preview matching the request host
+//   - git.repo.<name>.preview.path: the directory of the matching preview
+func (m *Endpoint) Placeholders(r *http.Request) map[string]string {
+	output := make(map[string]string)
+	if manager == nil {
+		return output
+	}
+	for name, repo := range manager.repos {
+		prefix := "git.repo." + name
+		output[prefix+".path"] = filepath.Join(expandDir(repo.Config.BaseDir), name)
+		for _, branch := range repo.Config.Branches {
+			output[prefix+".branch."+branch+".path"] = repo.branchDir(branch)
+		}
+		if repo.Config.Preview == nil {
+			continue
+		}
+		output[prefix+".previews.path"] = repo.previewsDir()
+		if id := matchPreviewHost(repo.Config.Preview.Host, r.Host); id != "" {
+			output[prefix+".preview.id"] = id
+			output[prefix+".preview.path"] = filepath.Join(repo.previewsDir(), id)
+		}
+	}
+	return output
+}
@@ -0,0 +1,320 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const previewRefPrefix = "refs/previews/"
+
+// previewEvent is the subset of GitHub, Gitea and GitLab webhook payloads
+// used to manage preview deployments.
+type previewEvent struct {
+	Action           string `json:"action,omitempty"`
+	Number           int    `json:"number,omitempty"`
+	Ref              string `json:"ref,omitempty"`
+	Before           string `json:"before,omitempty"`
+	After            string `json:"after,omitempty"`
+	ObjectAttributes struct {
+		IID    int    `json:"iid,omitempty"`
+		Action string `json:"action,omitempty"`
+	} `json:"object_attributes,omitempty"`
+}
+
+// previewAction is the action taken on a preview deployment.
+type previewAction struct {
+	id     string
+	src    plumbing.ReferenceName
+	remove bool
+}
+
+// parsePreviewEvent parses webhook request and returns the action to take
+// on a preview deployment. The nil action means that the event is not
+// related to previews.
+func (r *Repository) parsePreviewEvent(hdr http.Header, body []byte) (*previewAction, error) {
+	var eventType string
+	for _, k := range []string{"X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event", "X-Gitlab-Event"} {
+		if v := hdr.Get(k); v != "" {
+			eventType = v
+			break
+		}
+	}
+	if eventType == "" {
+		return nil, nil
+	}
+
+	event := &previewEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, fmt.Errorf("malformed %s event: %v", eventType, err)
+	}
+
+	switch eventType {
+	case "pull_request":
+		if event.Number < 1 {
+			return nil, nil
+		}
+		id := fmt.Sprintf("pr-%d", event.Number)
+		src := plumbing.ReferenceName(fmt.Sprintf("refs/pull/%d/head", event.Number))
+		switch event.Action {
+		case "opened", "reopened", "synchronize", "synchronized":
+			return &previewAction{id: id, src: src}, nil
+		case "closed":
+			return &previewAction{id: id, remove: true}, nil
+		}
+	case "Merge Request Hook":
+		if event.ObjectAttributes.IID < 1 {
+			return nil, nil
+		}
+		id := fmt.Sprintf("mr-%d", event.ObjectAttributes.IID)
+		src := plumbing.ReferenceName(fmt.Sprintf("refs/merge-requests/%d/head", event.ObjectAttributes.IID))
+		switch event.ObjectAttributes.Action {
+		case "open", "reopen", "update":
+			return &previewAction{id: id, src: src}, nil
+		case "close", "merge":
+			return &previewAction{id: id, remove: true}, nil
+		}
+	case "push", "Push Hook":
+		src := plumbing.ReferenceName(event.Ref)
+		if !src.IsBranch() || r.isTrackedBranch(src.Short()) {
+			return nil, nil
+		}
+		id := previewID(src.Short())
+		switch {
+		case strings.Trim(event.After, "0") == "":
+			return &previewAction{id: id, remove: true}, nil
+		case strings.Trim(event.Before, "0") == "":
+			return &previewAction{id: id, src: src}, nil
+		case r.previewExists(id):
+			return &previewAction{id: id, src: src}, nil
+		}
+	}
+	return nil, nil
+}
+
+// isTrackedBranch checks whether the branch is deployed by the regular
+// updates of the repository.
+func (r *Repository) isTrackedBranch(branch string) bool {
+	if branch == r.Config.Branch {
+		return true
+	}
+	for _, b := range r.Config.Branches {
+		if branch == b {
+			return true
+		}
+	}
+	if r.Config.Branch != "" || len(r.Config.Branches) > 0 {
+		return false
+	}
+	repo, err := r.objectStore()
+	if err != nil {
+		return false
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return false
+	}
+	return head.Target().Short() == branch
+}
+
+// runPreviewAction deploys or removes a preview.
+func (r *Repository) runPreviewAction(action *previewAction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if action.remove {
+		return r.removePreview(action.id)
+	}
+	return r.deployPreview(action.id, action.src)
+}
+
+// deployPreview fetches the source reference and writes its tree into the
+// directory of the preview.
+func (r *Repository) deployPreview(id string, src plumbing.ReferenceName) error {
+	repo, err := r.objectStore()
+	if err != nil {
+		return err
+	}
+	dst := plumbing.ReferenceName(previewRefPrefix + id)
+	opts := &git.FetchOptions{}
+	if err := configureFetchOptions(r.Config, opts); err != nil {
+		return err
+	}
+	opts.RefSpecs = []config.RefSpec{config.RefSpec("+" + src.String() + ":" + dst.String())}
+	opts.Tags = git.NoTags
+	if err := repo.Fetch(opts); err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	ref, err := repo.Reference(dst, true)
+	if err != nil {
+		return err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+	if err := r.verifyCommits(repo, plumbing.ZeroHash, commit); err != nil {
+		return err
+	}
+	if err := r.checkPreviewSymlinks(commit); err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	previewDir := filepath.Join(r.previewsDir(), id)
+	if err := exportTree(tree, "", previewDir, r.newLFSStore()); err != nil {
+		return err
+	}
+	// The modification time of the directory tracks the last deployment.
+	now := time.Now()
+	if err := os.Chtimes(previewDir, now, now); err != nil {
+		return err
+	}
+	r.logger.Info(
+		"deployed preview",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("preview_id", id),
+		zap.String("source", src.String()),
+		zap.String("commit", commit.Hash.String()),
+	)
+	return nil
+}
+
+// removePreview removes the directory and the reference of the preview.
+func (r *Repository) removePreview(id string) error {
+	if err := os.RemoveAll(filepath.Join(r.previewsDir(), id)); err != nil {
+		return err
+	}
+	if repo, err := r.objectStore(); err == nil {
+		repo.Storer.RemoveReference(plumbing.ReferenceName(previewRefPrefix + id))
+	}
+	r.logger.Info(
+		"removed preview",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("preview_id", id),
+	)
+	return nil
+}
+
+// collectPreviews removes the previews, which were not deployed within TTL.
+func (r *Repository) collectPreviews() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries, err := os.ReadDir(r.previewsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	deadline := time.Now().Add(-time.Duration(r.Config.Preview.TTL) * time.Second)
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil || !entry.IsDir() || fi.ModTime().After(deadline) {
+			continue
+		}
+		if err := r.removePreview(entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) previewExists(id string) bool {
+	exists, err := dirExists(filepath.Join(r.previewsDir(), id))
+	return err == nil && exists
+}
+
+// previewsDir returns the directory where the previews are being deployed.
+func (r *Repository) previewsDir() string {
+	return r.Config.previewsDir()
+}
+
+// previewsDir returns the directory where the previews are being deployed.
+func (rc *RepositoryConfig) previewsDir() string {
+	if rc.Preview != nil && rc.Preview.Dir != "" {
+		return expandDir(rc.Preview.Dir)
+	}
+	return filepath.Join(expandDir(rc.BaseDir), rc.Name, "previews")
+}
+
+// objectStore opens the repository holding the objects of the deployments.
+func (r *Repository) objectStore() (*git.Repository, error) {
+	repoDir := path.Join(expandDir(r.Config.BaseDir), r.Config.Name)
+	if r.Config.Deploy == deployExport || len(r.Config.Branches) > 0 {
+		return r.openBare(r.exportGitDir(repoDir))
+	}
+	return r.openRepository(repoDir)
+}
+
+// previewID converts branch name to the identifier of a preview. The
+// prefix keeps the branch previews apart from the pull request ones, e.g.
+// branch pr/42 and pull request 42.
+func previewID(branch string) string {
+	return "branch-" + strings.ReplaceAll(branch, "/", "-")
+}
+
+// matchPreviewHost returns the identifier of the preview matching the host,
+// e.g. pr-42 for pr-42.preview.example.com and *.preview.example.com pattern.
+func matchPreviewHost(pattern, host string) string {
+	if i := strings.LastIndex(host, ":"); i > 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return ""
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(host) <= len(prefix)+len(suffix) || !strings.HasPrefix(host, prefix) || !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+	id := host[len(prefix) : len(host)-len(suffix)]
+	if strings.Contains(id, ".") {
+		return ""
+	}
+	return id
+}
+
+func previewCollector(r *Repository) {
+	r.logger.Debug(
+		"preview collection enabled",
+		zap.String("repo_name", r.Config.Name),
+		zap.Int("ttl", r.Config.Preview.TTL),
+	)
+	intervals := time.NewTicker(time.Minute)
+	defer intervals.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-intervals.C:
+		}
+		if err := r.collectPreviews(); err != nil {
+			r.logger.Error("failed collecting previews", zap.String("repo_name", r.Config.Name), zap.Error(err))
+		}
+	}
+}
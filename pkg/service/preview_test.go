@@ -0,0 +1,239 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+func TestRepositoryPreviews(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("main")})
+	upstream.branch("feature")
+	upstream.commit("pull request commit", map[string][]byte{"index.html": []byte("pr")})
+	upstream.pushRef("refs/heads/master", "refs/pull/42/head")
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Branch:  "feature",
+		Preview: &PreviewConfig{Host: "*.preview.example.com", TTL: 3600},
+		Webhooks: []*WebhookConfig{
+			{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"},
+		},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+	manager = &Manager{repos: map[string]*Repository{r.Config.Name: r}}
+	defer func() {
+		manager = nil
+	}()
+	endpoint := &Endpoint{RepositoryName: r.Config.Name, logger: zap.NewNop()}
+
+	send := func(event, payload string) int {
+		req := httptest.NewRequest("POST", "/update", strings.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", event)
+		h := hmac.New(sha256.New, []byte("foobar"))
+		h.Write([]byte(payload))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(h.Sum(nil)))
+		rr := httptest.NewRecorder()
+		if err := endpoint.ServeHTTP(req.Context(), rr, req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rr.Code
+	}
+
+	previewDir := filepath.Join(r.previewsDir(), "pr-42")
+	if code := send("pull_request", `{"action": "opened", "number": 42}`); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if diff := cmp.Diff("pr", readTestFile(t, filepath.Join(previewDir, "index.html"))); diff != "" {
+		t.Fatalf("unexpected preview content (-want +got):\n%s", diff)
+	}
+
+	req := httptest.NewRequest("GET", "https://pr-42.preview.example.com/", nil)
+	placeholders := endpoint.Placeholders(req)
+	if diff := cmp.Diff(previewDir, placeholders["git.repo.test.preview.path"]); diff != "" {
+		t.Fatalf("unexpected preview path placeholder (-want +got):\n%s", diff)
+	}
+
+	if code := send("pull_request", `{"action": "closed", "number": 42}`); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if _, err := os.Stat(previewDir); !os.IsNotExist(err) {
+		t.Fatalf("expected preview removed, got: %v", err)
+	}
+
+	upstream.branch("docs/next")
+	zeros := strings.Repeat("0", 40)
+	previewDir = filepath.Join(r.previewsDir(), "branch-docs-next")
+	if code := send("push", `{"ref": "refs/heads/docs/next", "before": "`+zeros+`", "after": "abc"}`); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(previewDir, "index.html")); err != nil {
+		t.Fatalf("expected branch preview deployed, got: %v", err)
+	}
+
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(previewDir, past, past); err != nil {
+		t.Fatalf("failed changing preview mtime: %v", err)
+	}
+	if err := r.collectPreviews(); err != nil {
+		t.Fatalf("failed collecting previews: %v", err)
+	}
+	if _, err := os.Stat(previewDir); !os.IsNotExist(err) {
+		t.Fatalf("expected stale preview removed, got: %v", err)
+	}
+}
+
+func TestRepositoryPreviewsWithExport(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	upstream.branch("feature")
+	upstream.commit("pull request commit", map[string][]byte{"index.html": []byte("pr")})
+	upstream.pushRef("refs/heads/master", "refs/pull/42/head")
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Branch:  "feature",
+		Deploy:  "export",
+		Preview: &PreviewConfig{},
+		Webhooks: []*WebhookConfig{
+			{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"},
+		},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed exporting repo: %v", err)
+	}
+	if err := r.runPreviewAction(&previewAction{id: "pr-42", src: "refs/pull/42/head"}); err != nil {
+		t.Fatalf("failed deploying preview: %v", err)
+	}
+
+	upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+	upstream.branch("feature")
+	if err := r.update(); err != nil {
+		t.Fatalf("failed exporting repo: %v", err)
+	}
+	publishDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	want := []string{"index.html", "previews/pr-42/index.html"}
+	if diff := cmp.Diff(want, listTestFiles(t, publishDir)); diff != "" {
+		t.Fatalf("unexpected files after update (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("pr", readTestFile(t, filepath.Join(publishDir, "previews", "pr-42", "index.html"))); diff != "" {
+		t.Fatalf("unexpected preview content (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryPreviewsRejectEscapingSymlink(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("main")})
+	upstream.branch("feature")
+	upstream.symlink("x", "/etc")
+	upstream.pushRef("refs/heads/master", "refs/pull/42/head")
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: upstream.bareDir,
+		Branch:  "feature",
+		Preview: &PreviewConfig{},
+		Webhooks: []*WebhookConfig{
+			{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"},
+		},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+	if err := r.runPreviewAction(&previewAction{id: "pr-42", src: "refs/pull/42/head"}); err == nil {
+		t.Fatalf("expected preview with escaping symlink rejected")
+	}
+	if r.previewExists("pr-42") {
+		t.Fatalf("expected preview not deployed")
+	}
+}
+
+func TestEndpointRejectsLargeBody(t *testing.T) {
+	r := newTestRepository(t, &RepositoryConfig{
+		Address: "https://github.com/authp/authp.github.io.git",
+		Webhooks: []*WebhookConfig{
+			{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"},
+		},
+	})
+	manager = &Manager{repos: map[string]*Repository{r.Config.Name: r}}
+	defer func() {
+		manager = nil
+	}()
+	endpoint := &Endpoint{RepositoryName: r.Config.Name, logger: zap.NewNop()}
+
+	payload := strings.Repeat("x", maxRequestBodySize+1)
+	req := httptest.NewRequest("POST", "/update", strings.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", "push")
+	rr := httptest.NewRecorder()
+	if err := endpoint.ServeHTTP(req.Context(), rr, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(http.StatusRequestEntityTooLarge, rr.Code); diff != "" {
+		t.Fatalf("unexpected status code (-want +got):\n%s", diff)
+	}
+}
+
+func TestPreviewID(t *testing.T) {
+	if diff := cmp.Diff("branch-pr-42", previewID("pr/42")); diff != "" {
+		t.Fatalf("unexpected preview id (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidatePreviewWithoutWebhook(t *testing.T) {
+	rc := &RepositoryConfig{
+		Address: "https://github.com/authp/authp.github.io.git",
+		Preview: &PreviewConfig{Host: "*.preview.example.com"},
+	}
+	err := rc.validate()
+	if diff := cmp.Diff("repository config preview requires webhook", fmt.Sprint(err)); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+}
+
+func TestMatchPreviewHost(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		host    string
+		want    string
+	}{
+		{pattern: "*.preview.example.com", host: "pr-42.preview.example.com", want: "pr-42"},
+		{pattern: "*.preview.example.com", host: "pr-42.preview.example.com:8443", want: "pr-42"},
+		{pattern: "preview-*.example.com", host: "preview-docs-next.example.com", want: "docs-next"},
+		{pattern: "*.preview.example.com", host: "a.b.preview.example.com"},
+		{pattern: "*.preview.example.com", host: "preview.example.com"},
+		{pattern: "*.preview.example.com", host: "www.example.com"},
+	} {
+		t.Run(tc.host, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, matchPreviewHost(tc.pattern, tc.host)); diff != "" {
+				t.Fatalf("matchPreviewHost() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// CredentialProvider provides the authentication of the repository in place
+// of AuthConfig. The provider is called before every clone, fetch and LFS
+// request, so that it may return the rotated credentials. The providers are
+// the Caddy modules in git.auth namespace.
+type CredentialProvider interface {
+	AuthMethod(req *CredentialRequest) (transport.AuthMethod, error)
+}
+
+// CredentialRequest describes the repository the authentication is
+// requested for.
+type CredentialRequest struct {
+	Repository string
+	URL        string
+	Transport  string
+}
+
+// IsHTTP checks whether the repository is fetched over HTTP(S). The
+// authentication must implement http.AuthMethod of go-git then.
+func (req *CredentialRequest) IsHTTP() bool {
+	return isHTTPTransport(req.Transport)
+}
+
+// IsSSH checks whether the repository is fetched over SSH. The
+// authentication must implement ssh.AuthMethod of go-git then.
+func (req *CredentialRequest) IsSSH() bool {
+	return isSSHTransport(req.Transport)
+}
+
+// SetAuthProvider sets the credential provider loaded from AuthProviderRaw.
+func (rc *RepositoryConfig) SetAuthProvider(p CredentialProvider) {
+	rc.authProvider = p
+}
+
+// providedAuth returns the authentication of the credential provider.
+func (rc *RepositoryConfig) providedAuth() (transport.AuthMethod, error) {
+	return rc.authProvider.AuthMethod(&CredentialRequest{
+		Repository: rc.Name,
+		URL:        rc.Address,
+		Transport:  rc.transport,
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/caddy-git/pkg/errors"
+)
+
+// testProvider returns the current token, and records the requests.
+type testProvider struct {
+	token    atomic.Value
+	requests []CredentialRequest
+	err      error
+}
+
+func (p *testProvider) AuthMethod(req *CredentialRequest) (transport.AuthMethod, error) {
+	p.requests = append(p.requests, *req)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &githttp.TokenAuth{Token: p.token.Load().(string)}, nil
+}
+
+func TestRepositoryUpdateAuthProvider(t *testing.T) {
+	var validToken atomic.Value
+	validToken.Store("token-1")
+	authorized := func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer "+validToken.Load().(string)
+	}
+
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	server := newTestHTTPServer(t, filepath.Dir(upstream.bareDir), authorized)
+	address := server.URL + "/" + filepath.Base(upstream.bareDir)
+
+	provider := &testProvider{}
+	provider.token.Store("token-1")
+	r := newTestRepository(t, &RepositoryConfig{
+		Name:         "foo",
+		Address:      address,
+		authProvider: provider,
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+
+	// The provider is asked before every fetch, so that the rotated token
+	// is used.
+	validToken.Store("token-2")
+	provider.token.Store("token-2")
+	upstream.commit("update", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating repo with rotated token: %v", err)
+	}
+	got := readTestFile(t, filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html"))
+	if diff := cmp.Diff("v2", got); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+	want := []CredentialRequest{
+		{Repository: "foo", URL: address, Transport: transportHTTP},
+		{Repository: "foo", URL: address, Transport: transportHTTP},
+	}
+	if diff := cmp.Diff(want, provider.requests); diff != "" {
+		t.Fatalf("unexpected credential requests (-want +got):\n%s", diff)
+	}
+
+	provider.err = fmt.Errorf("vault is sealed")
+	if err := r.update(); err == nil {
+		t.Fatalf("expected credential provider error")
+	}
+}
+
+func TestValidateAuthProvider(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rc   *RepositoryConfig
+		err  error
+	}{
+		{
+			name: "test auth provider with ssh remote",
+			rc: &RepositoryConfig{
+				Address:      "git@github.com:authp/authp.github.io.git",
+				authProvider: &testProvider{},
+			},
+		},
+		{
+			name: "test auth provider with auth",
+			rc: &RepositoryConfig{
+				Address:         "https://github.com/authp/authp.github.io.git",
+				Auth:            &AuthConfig{Token: "foo"},
+				AuthProviderRaw: []byte(`{"provider":"http"}`),
+			},
+			err: errors.ErrRepositoryConfigAuthProviderConflict,
+		},
+		{
+			name: "test auth provider with local remote",
+			rc: &RepositoryConfig{
+				Address:      "/tmp/authp.github.io.git",
+				authProvider: &testProvider{},
+			},
+			err: errors.ErrRepositoryConfigAuthUnsupported.WithArgs("file"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rc.validate()
+			if tc.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+				t.Fatalf("unexpected error (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
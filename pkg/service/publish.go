@@ -0,0 +1,80 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"path"
+	"strings"
+)
+
+// runPublish mirrors the configured directories of the tree at HEAD into
+// their destination directories.
+func (r *Repository) runPublish() error {
+	tree, err := r.headTree()
+	if err != nil {
+		return err
+	}
+	for _, entry := range r.Config.Publish {
+		src := path.Clean(strings.Trim(entry.Source, "/"))
+		if src == "." {
+			src = ""
+		}
+		if src != "" {
+			if _, err := tree.Tree(src); err != nil {
+				return fmt.Errorf("failed publishing %q: %v", entry.Source, err)
+			}
+		}
+		dest := expandDir(entry.Destination)
+		if err := exportTree(tree, src, dest, r.newLFSStore()); err != nil {
+			return err
+		}
+		r.logger.Debug(
+			"published repo directory",
+			zap.String("repo_name", r.Config.Name),
+			zap.String("source", entry.Source),
+			zap.String("destination", dest),
+		)
+	}
+	return nil
+}
+
+// headTree returns the tree of the commit deployed by the latest update.
+func (r *Repository) headTree() (*object.Tree, error) {
+	repoDir := path.Join(r.Config.BaseDir, r.Config.Name)
+	var repo *git.Repository
+	var err error
+	switch r.Config.Deploy {
+	case deployExport:
+		repo, err = r.openBare(r.exportGitDir(repoDir))
+	default:
+		repo, err = r.openRepository(repoDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
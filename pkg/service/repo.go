@@ -19,15 +19,15 @@ import (
 	"fmt"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"go.uber.org/zap"
-	cryptossh "golang.org/x/crypto/ssh"
+	nethttp "net/http"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -38,18 +38,33 @@ type Repository struct {
 	Config      *RepositoryConfig `json:"config,omitempty"`
 	mu          sync.Mutex
 	logger      *zap.Logger
+	storage     Storage
 	lastUpdated time.Time
 	updating    bool
+	statusMu    sync.Mutex
+	status      Status
+	// The background loops of the repository exit when done is closed.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewRepository returns an instance of Repository.
 func NewRepository(rc *RepositoryConfig) (*Repository, error) {
 	r := &Repository{
 		Config: rc,
+		done:   make(chan struct{}),
 	}
 	return r, nil
 }
 
+// stop stops the background loops of the repository.
+func (r *Repository) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+		r.Config.closeAgent()
+	})
+}
+
 func (r *Repository) update() error {
 	if r.updating {
 		return nil
@@ -62,7 +77,32 @@ func (r *Repository) update() error {
 		r.updating = false
 	}()
 
+	// The branches track their deployed commits separately.
+	commitMtimes := r.Config.CommitMtimes && len(r.Config.Branches) == 0
+	var deployed plumbing.Hash
+	if commitMtimes {
+		deployed = r.deployedHead()
+	}
+
+	if r.Config.Auth != nil && r.Config.Auth.KeyAuto && r.Config.deployKey == nil {
+		if err := r.loadDeployKey(); err != nil {
+			r.setStatus(err)
+			return err
+		}
+	}
+
+	if r.Config.Auth != nil && r.Config.Auth.Certificate != "" {
+		r.checkCertificate()
+	}
+
 	err := r.runUpdate()
+	if err == nil && len(r.Config.Publish) > 0 {
+		err = r.runPublish()
+	}
+	if err == nil && commitMtimes {
+		err = r.runCommitTimes(deployed)
+	}
+	r.setStatus(err)
 	if err != nil {
 		return err
 	}
@@ -102,6 +142,7 @@ func (r *Repository) runPostPullExec() {
 
 func (r *Repository) runUpdate() error {
 	r.Config.BaseDir = expandDir(r.Config.BaseDir)
+	r.Config.GitDir = expandDir(r.Config.GitDir)
 
 	baseDirExists, err := dirExists(r.Config.BaseDir)
 	if err != nil {
@@ -114,57 +155,159 @@ func (r *Repository) runUpdate() error {
 	}
 
 	repoDir := path.Join(r.Config.BaseDir, r.Config.Name)
-	repoDirExists, err := dirExists(repoDir)
+	if err := r.migrateGitDir(repoDir); err != nil {
+		return err
+	}
+	if err := r.recoverRepository(repoDir); err != nil {
+		return err
+	}
+	switch {
+	case r.Config.Mode == modeMirror:
+		return r.runMirrorUpdate(repoDir)
+	case len(r.Config.Branches) > 0:
+		return r.runBranchesUpdate(repoDir)
+	case r.Config.Deploy == deployExport:
+		return r.runExportUpdate(repoDir)
+	}
+
+	if err := r.runCheckoutUpdate(repoDir); err != nil {
+		return err
+	}
+	if r.Config.LFS != nil {
+		repo, err := r.openRepository(repoDir)
+		if err != nil {
+			return err
+		}
+		return r.smudgeWorktree(repo, repoDir)
+	}
+	return nil
+}
+
+// runCheckoutUpdate clones the repository into repoDir, or pulls the
+// updates into the existing checkout.
+func (r *Repository) runCheckoutUpdate(repoDir string) error {
+	repoExists, err := r.repositoryExists(repoDir)
 	if err != nil {
 		return err
 	}
-	if !repoDirExists {
+	if !repoExists {
 		// Clone the repository.
 		opts := &git.CloneOptions{}
 		if err := configureCloneOptions(r.Config, opts); err != nil {
 			return err
 		}
-		if _, err := git.PlainClone(repoDir, false, opts); err != nil {
+		// Only the tracked branch is cloned.
+		opts.SingleBranch = true
+		if r.Config.VerifySignatures != nil || r.Config.LFS != nil || r.restrictsSymlinks() {
+			// The worktree is checked out after the verification, or with
+			// the content of LFS objects.
+			opts.NoCheckout = true
+		}
+		repo, err := r.cloneRepository(repoDir, opts)
+		if err != nil {
 			return err
 		}
+		if err := trackDefaultBranch(repo); err != nil {
+			return err
+		}
+		if !opts.NoCheckout {
+			r.logger.Debug(
+				"cloned repo",
+				zap.String("repo_name", r.Config.Name),
+			)
+			return nil
+		}
 	}
 
-	// Pull the repository.
-	repoDir, err = filepath.Abs(repoDir)
+	// The updates are fetched and the worktree is fast-forwarded instead
+	// of the pull, which fails on the shallow clones and fetches all tags.
+	return r.runFetchUpdate(repoDir, !repoExists)
+}
+
+// runFetchUpdate fetches the updates of the tracked branch and moves the
+// worktree to its tip only when the signatures of the new commits are
+// verified. The rejected clone is removed, so that it is retried. With LFS,
+// the worktree receives the content of LFS objects in place of pointers.
+func (r *Repository) runFetchUpdate(repoDir string, cloned bool) error {
+	repo, err := r.openRepository(repoDir)
 	if err != nil {
 		return err
 	}
-	repo, err := git.PlainOpen(repoDir)
+	if !cloned {
+		if err := r.fetch(repo); err != nil {
+			return err
+		}
+	}
+
+	head, err := repo.Storer.Reference(plumbing.HEAD)
 	if err != nil {
 		return err
 	}
-	w, err := repo.Worktree()
+	branch := head.Target()
+	if head.Type() != plumbing.SymbolicReference || !branch.IsBranch() {
+		return plumbing.ErrReferenceNotFound
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch.Short()), true)
 	if err != nil {
 		return err
 	}
 
-	opts := &git.PullOptions{}
-	if err := configurePullOptions(r.Config, opts); err != nil {
-		return err
-	}
-	if err := w.Pull(opts); err != nil {
-		if err == git.NoErrAlreadyUpToDate {
+	var old plumbing.Hash
+	if !cloned {
+		if ref, err := repo.Reference(branch, true); err == nil {
+			old = ref.Hash()
+		}
+		if old == remoteRef.Hash() {
 			r.logger.Debug(
 				"repo is already up to date",
 				zap.String("repo_name", r.Config.Name),
 			)
 			return nil
 		}
-		return err
 	}
-	ref, err := repo.Head()
+
+	commit, err := r.verifyTip(repo, old, remoteRef.Hash())
+	if err == nil {
+		err = r.checkSymlinks(commit)
+	}
 	if err != nil {
+		if cloned {
+			os.RemoveAll(repoDir)
+			if r.Config.GitDir != "" {
+				os.RemoveAll(r.Config.GitDir)
+			}
+		}
+		return err
+	}
+
+	var oldTree *object.Tree
+	if !old.IsZero() {
+		if oldCommit, err := repo.CommitObject(old); err == nil {
+			oldTree, _ = oldCommit.Tree()
+		}
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, commit.Hash)); err != nil {
 		return err
 	}
-	commit, err := repo.CommitObject(ref.Hash())
+	w, err := repo.Worktree()
 	if err != nil {
 		return err
 	}
+	mode := git.MergeReset
+	switch {
+	case r.Config.LFS != nil:
+		// The replaced LFS pointers are unstaged changes to go-git, so the
+		// worktree is updated here and only the index is reset.
+		if err := r.checkoutTree(repoDir, oldTree, commit); err != nil {
+			return err
+		}
+		mode = git.MixedReset
+	case cloned:
+		mode = git.HardReset
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: commit.Hash, Mode: mode}); err != nil {
+		return err
+	}
 
 	r.logger.Debug(
 		"pulled latest commit",
@@ -187,7 +330,7 @@ func dirExists(s string) (bool, error) {
 }
 
 func configureCloneOptions(cfg *RepositoryConfig, opts *git.CloneOptions) error {
-	opts.URL = cfg.Address
+	opts.URL = cfg.cloneURL()
 	trAuthMethod, err := configureAuthOptions(cfg)
 	if err != nil {
 		return err
@@ -199,10 +342,13 @@ func configureCloneOptions(cfg *RepositoryConfig, opts *git.CloneOptions) error
 	if cfg.Branch != "" {
 		opts.ReferenceName = plumbing.NewBranchReferenceName(cfg.Branch)
 	}
+	if cfg.NoTags {
+		opts.Tags = git.NoTags
+	}
 	return nil
 }
 
-func configurePullOptions(cfg *RepositoryConfig, opts *git.PullOptions) error {
+func configureFetchOptions(cfg *RepositoryConfig, opts *git.FetchOptions) error {
 	opts.RemoteName = "origin"
 	trAuthMethod, err := configureAuthOptions(cfg)
 	if err != nil {
@@ -212,68 +358,115 @@ func configurePullOptions(cfg *RepositoryConfig, opts *git.PullOptions) error {
 	if cfg.Depth > 0 {
 		opts.Depth = cfg.Depth
 	}
-	if cfg.Branch != "" {
-		opts.ReferenceName = plumbing.NewBranchReferenceName(cfg.Branch)
-		opts.SingleBranch = true
+	if cfg.NoTags {
+		opts.Tags = git.NoTags
 	}
 	return nil
 }
 
+// configureAuthOptions returns the authentication of the Repository, which
+// is provided by the credential provider, when it is set. The
+// authentication of HTTP(S) remotes carries the HTTP client configured with
+// the TLS and proxy options.
 func configureAuthOptions(cfg *RepositoryConfig) (transport.AuthMethod, error) {
+	client, err := cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	var auth transport.AuthMethod
+	if cfg.authProvider != nil {
+		auth, err = cfg.providedAuth()
+	} else {
+		auth, err = configureCredentials(cfg, client)
+	}
+	if err != nil || client == nil || !isHTTPTransport(cfg.transport) {
+		return auth, err
+	}
+	httpAuth, _ := auth.(http.AuthMethod)
+	return &clientAuth{auth: httpAuth, client: client}, nil
+}
+
+// configureCredentials returns the authentication with the credentials of
+// the Repository.
+func configureCredentials(cfg *RepositoryConfig, client *nethttp.Client) (transport.AuthMethod, error) {
 	if cfg.Auth == nil {
 		return nil, nil
 	}
-	cfg.Auth.KeyPath = expandDir(cfg.Auth.KeyPath)
+	ac, err := cfg.Auth.loadSecrets(client)
+	if err != nil {
+		return nil, err
+	}
+	ac.KeyPath = expandDir(ac.KeyPath)
 
-	switch cfg.transport {
-	case "http":
+	switch {
+	case isHTTPTransport(cfg.transport):
 		// Configure authentication for HTTP/S.
 		switch {
-		case cfg.Auth.Username != "":
+		case ac.Token != "" && ac.Username == "":
+			return &http.TokenAuth{Token: string(ac.Token)}, nil
+		case ac.Token != "":
+			// The personal access tokens are sent as the password.
 			return &http.BasicAuth{
-				Username: cfg.Auth.Username,
-				Password: cfg.Auth.Password,
+				Username: ac.Username,
+				Password: string(ac.Token),
+			}, nil
+		case ac.Username != "":
+			return &http.BasicAuth{
+				Username: ac.Username,
+				Password: string(ac.Password),
 			}, nil
 		}
-	case "ssh":
+	case isSSHTransport(cfg.transport):
 		// Configure authentication for SSH.
+		publicKeysUser := "git"
 		switch {
-		case cfg.Auth.KeyPath != "":
-			var publicKeysUser string
-			switch {
-			case strings.Contains(cfg.Address, "@"):
-				cfgAddressArr := strings.SplitN(cfg.Address, "@", 2)
-				publicKeysUser = cfgAddressArr[0]
-			case cfg.Auth.Username != "":
-				publicKeysUser = cfg.Auth.Username
-			}
+		case cfg.endpoint != nil && cfg.endpoint.User != "":
+			publicKeysUser = cfg.endpoint.User
+		case ac.Username != "":
+			publicKeysUser = ac.Username
+		}
 
-			if publicKeysUser == "" {
-				publicKeysUser = "git"
+		var auth ssh.AuthMethod
+		switch {
+		case ac.KeyPath != "":
+			publicKeys, err := ssh.NewPublicKeysFromFile(publicKeysUser, ac.KeyPath, string(ac.KeyPassphrase))
+			if err != nil {
+				return nil, err
 			}
-
-			publicKeys, err := ssh.NewPublicKeysFromFile(publicKeysUser, cfg.Auth.KeyPath, cfg.Auth.KeyPassphrase)
+			auth = publicKeys
+		case ac.KeyAuto:
+			if cfg.deployKey == nil {
+				return nil, fmt.Errorf("deploy key is not loaded")
+			}
+			auth = &ssh.PublicKeys{User: publicKeysUser, Signer: cfg.deployKey}
+		case ac.KeyData != "":
+			publicKeys, err := ssh.NewPublicKeys(publicKeysUser, []byte(ac.KeyData), string(ac.KeyPassphrase))
 			if err != nil {
 				return nil, err
 			}
-			if cfg.Auth.StrictHostKeyCheckingDisabled {
-				publicKeys.HostKeyCallbackHelper = ssh.HostKeyCallbackHelper{
-					HostKeyCallback: cryptossh.InsecureIgnoreHostKey(),
-				}
+			auth = publicKeys
+		case ac.Agent:
+			agentAuth, err := cfg.newAgentAuth(publicKeysUser, ac.AgentSocket)
+			if err != nil {
+				return nil, err
 			}
-			return publicKeys, nil
-		case cfg.Auth.Username != "":
-			password := &ssh.Password{
-				User:     cfg.Auth.Username,
-				Password: cfg.Auth.Password,
+			auth = agentAuth
+		case ac.Username != "":
+			auth = &ssh.Password{
+				User:     ac.Username,
+				Password: string(ac.Password),
 			}
-			if cfg.Auth.StrictHostKeyCheckingDisabled {
-				password.HostKeyCallbackHelper = ssh.HostKeyCallbackHelper{
-					HostKeyCallback: cryptossh.InsecureIgnoreHostKey(),
-				}
+		default:
+			return nil, nil
+		}
+		if publicKeys, ok := auth.(*ssh.PublicKeys); ok && ac.Certificate != "" {
+			signer, err := newCertificateSigner(publicKeys.Signer, ac.Certificate)
+			if err != nil {
+				return nil, err
 			}
-			return password, nil
+			publicKeys.Signer = signer
 		}
+		return ac.configureHostKey(auth, cfg.endpoint)
 	}
 	return nil, nil
 }
@@ -298,9 +491,11 @@ func autoUpdater(r *Repository) {
 	)
 	intervals := time.NewTicker(time.Second * time.Duration(r.Config.UpdateInterval))
 	defer intervals.Stop()
-	for range intervals.C {
-		if r == nil {
-			break
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-intervals.C:
 		}
 		if err := r.update(); err != nil {
 			r.logger.Error("failed auto-updating repo", zap.String("repo_name", r.Config.Name), zap.Error(err))
@@ -308,5 +503,4 @@ func autoUpdater(r *Repository) {
 		}
 		r.logger.Debug("auto-updated repo", zap.String("repo_name", r.Config.Name))
 	}
-	return
 }
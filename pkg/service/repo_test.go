@@ -0,0 +1,436 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+// testUpstream is a local upstream repository used as a no-network fixture.
+type testUpstream struct {
+	t       *testing.T
+	workDir string
+	bareDir string
+	repo    *git.Repository
+	// The commits are signed with the key, when set.
+	signKey *openpgp.Entity
+	// The commits are dated with the time, when set.
+	when time.Time
+}
+
+// newTestUpstream creates a work repository and a bare repository, which is
+// kept in sync with the work repository after every commit.
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	rootDir := t.TempDir()
+	u := &testUpstream{
+		t:       t,
+		workDir: filepath.Join(rootDir, "work"),
+		bareDir: filepath.Join(rootDir, "upstream.git"),
+	}
+	repo, err := git.PlainInit(u.workDir, false)
+	if err != nil {
+		t.Fatalf("failed initializing upstream: %v", err)
+	}
+	u.repo = repo
+	if _, err := git.PlainInit(u.bareDir, true); err != nil {
+		t.Fatalf("failed initializing bare upstream: %v", err)
+	}
+	return u
+}
+
+// commit writes the files to the work repository, commits them, and pushes
+// the commit to the bare repository. A nil file content removes the file.
+func (u *testUpstream) commit(msg string, files map[string][]byte) {
+	u.t.Helper()
+	w, err := u.repo.Worktree()
+	if err != nil {
+		u.t.Fatalf("failed opening upstream worktree: %v", err)
+	}
+	for name, content := range files {
+		fp := filepath.Join(u.workDir, name)
+		if content == nil {
+			if _, err := w.Remove(name); err != nil {
+				u.t.Fatalf("failed removing %s: %v", name, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			u.t.Fatalf("failed creating directory for %s: %v", name, err)
+		}
+		if err := os.WriteFile(fp, content, 0644); err != nil {
+			u.t.Fatalf("failed writing %s: %v", name, err)
+		}
+		if _, err := w.Add(name); err != nil {
+			u.t.Fatalf("failed adding %s: %v", name, err)
+		}
+	}
+	when := u.when
+	if when.IsZero() {
+		when = time.Now()
+	}
+	_, err = w.Commit(msg, &git.CommitOptions{
+		Author:  &object.Signature{Name: "Test", Email: "test@localhost", When: when},
+		SignKey: u.signKey,
+	})
+	if err != nil {
+		u.t.Fatalf("failed committing: %v", err)
+	}
+	u.push()
+}
+
+func (u *testUpstream) push() {
+	u.t.Helper()
+	if _, err := u.repo.Remote("origin"); err != nil {
+		if _, err := u.repo.CreateRemote(newTestRemoteConfig(u.bareDir)); err != nil {
+			u.t.Fatalf("failed creating upstream remote: %v", err)
+		}
+	}
+	err := u.repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		u.t.Fatalf("failed pushing to bare upstream: %v", err)
+	}
+}
+
+// branch creates the branch at HEAD of the work repository and pushes it.
+func (u *testUpstream) branch(name string) {
+	u.t.Helper()
+	head, err := u.repo.Head()
+	if err != nil {
+		u.t.Fatalf("failed resolving upstream HEAD: %v", err)
+	}
+	ref := plumbing.NewHashReference(plumbing.NewBranchReferenceName(name), head.Hash())
+	if err := u.repo.Storer.SetReference(ref); err != nil {
+		u.t.Fatalf("failed creating branch %s: %v", name, err)
+	}
+	u.push()
+}
+
+// deleteBranch deletes the branch from both the work and bare repositories.
+func (u *testUpstream) deleteBranch(name string) {
+	u.t.Helper()
+	refName := plumbing.NewBranchReferenceName(name)
+	if err := u.repo.Storer.RemoveReference(refName); err != nil {
+		u.t.Fatalf("failed deleting branch %s: %v", name, err)
+	}
+	err := u.repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec(":" + refName.String())},
+	})
+	if err != nil {
+		u.t.Fatalf("failed deleting upstream branch %s: %v", name, err)
+	}
+}
+
+// pushRef pushes the local reference of the work repository to the bare
+// repository under a different name, e.g. refs/pull/1/head.
+func (u *testUpstream) pushRef(src, dst string) {
+	u.t.Helper()
+	err := u.repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + src + ":" + dst)},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		u.t.Fatalf("failed pushing %s to %s: %v", src, dst, err)
+	}
+}
+
+func newTestRemoteConfig(url string) *config.RemoteConfig {
+	return &config.RemoteConfig{Name: "origin", URLs: []string{url}}
+}
+
+func newTestRepository(t *testing.T, rc *RepositoryConfig) *Repository {
+	t.Helper()
+	if rc.Name == "" {
+		rc.Name = "test"
+	}
+	if rc.BaseDir == "" {
+		rc.BaseDir = t.TempDir()
+	}
+	if err := rc.validate(); err != nil {
+		t.Fatalf("failed validating repository config: %v", err)
+	}
+	r, _ := NewRepository(rc)
+	r.logger = zap.NewNop()
+	return r
+}
+
+func readTestFile(t *testing.T, fp string) string {
+	t.Helper()
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatalf("failed reading %s: %v", fp, err)
+	}
+	return string(b)
+}
+
+func TestRepositoryUpdateLocalTransports(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		prefix string
+	}{
+		{name: "test local path"},
+		{name: "test file url", prefix: "file://"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+			r := newTestRepository(t, &RepositoryConfig{Address: tc.prefix + upstream.bareDir, Branch: "master"})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			fp := filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+			if diff := cmp.Diff("v1", readTestFile(t, fp)); diff != "" {
+				t.Fatalf("unexpected content after clone (-want +got):\n%s", diff)
+			}
+
+			upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed pulling repo: %v", err)
+			}
+			if diff := cmp.Diff("v2", readTestFile(t, fp)); diff != "" {
+				t.Fatalf("unexpected content after pull (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdateMirror(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	upstream.branch("staging")
+
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, Mode: "mirror"})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning mirror: %v", err)
+	}
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	if _, err := os.Stat(filepath.Join(repoDir, "index.html")); !os.IsNotExist(err) {
+		t.Fatalf("expected bare mirror without worktree, got: %v", err)
+	}
+
+	upstream.branch("docs-next")
+	upstream.deleteBranch("staging")
+	upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed updating mirror: %v", err)
+	}
+
+	mirror, err := git.PlainOpen(repoDir)
+	if err != nil {
+		t.Fatalf("failed opening mirror: %v", err)
+	}
+	got := make(map[string]string)
+	refs, _ := mirror.References()
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsBranch() {
+			got[ref.Name().Short()] = ref.Hash().String()
+		}
+		return nil
+	})
+	upstreamHead, _ := upstream.repo.Head()
+	docsNext, _ := upstream.repo.Reference(plumbing.NewBranchReferenceName("docs-next"), true)
+	want := map[string]string{
+		"master":    upstreamHead.Hash().String(),
+		"docs-next": docsNext.Hash().String(),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected mirror branches (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryUpdateSeparateGitDir(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	gitDir := filepath.Join(t.TempDir(), "test.git")
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, Branch: "master", GitDir: gitDir})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	if _, err := os.Stat(filepath.Join(repoDir, ".git")); !os.IsNotExist(err) {
+		t.Fatalf("expected no .git in %s, got: %v", repoDir, err)
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		t.Fatalf("expected repository metadata in %s, got: %v", gitDir, err)
+	}
+
+	upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed pulling repo: %v", err)
+	}
+	if diff := cmp.Diff("v2", readTestFile(t, filepath.Join(repoDir, "index.html"))); diff != "" {
+		t.Fatalf("unexpected content after pull (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryUpdateSeparateGitDirCloneFailure(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	gitDir := filepath.Join(t.TempDir(), "test.git")
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, Branch: "missing", GitDir: gitDir})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected clone error for missing branch")
+	}
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	for _, dir := range []string{repoDir, gitDir} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed after failed clone, got: %v", dir, err)
+		}
+	}
+
+	r.Config.Branch = "master"
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo after failed attempt: %v", err)
+	}
+	if diff := cmp.Diff("v1", readTestFile(t, filepath.Join(repoDir, "index.html"))); diff != "" {
+		t.Fatalf("unexpected content (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryUpdateSeparateGitDirExistingCheckout(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, Branch: "master"})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+
+	gitDir := filepath.Join(t.TempDir(), "test.git")
+	r.Config.GitDir = gitDir
+	upstream.commit("second commit", map[string][]byte{"index.html": []byte("v2")})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed pulling repo with git_dir: %v", err)
+	}
+	if diff := cmp.Diff("v2", readTestFile(t, filepath.Join(repoDir, "index.html"))); diff != "" {
+		t.Fatalf("unexpected content after pull (-want +got):\n%s", diff)
+	}
+	if fi, err := os.Lstat(filepath.Join(repoDir, ".git")); err == nil && fi.IsDir() {
+		t.Fatalf("expected .git moved out of %s", repoDir)
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		t.Fatalf("expected repository metadata in %s, got: %v", gitDir, err)
+	}
+}
+
+func TestRepositoryUpdateSeparateGitDirConflict(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, Branch: "master"})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+
+	gitDir := filepath.Join(t.TempDir(), "test.git")
+	if err := os.MkdirAll(gitDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	r.Config.GitDir = gitDir
+	if err := r.update(); err == nil {
+		t.Fatalf("expected error for conflicting git_dir")
+	}
+	if diff := cmp.Diff("v1", readTestFile(t, filepath.Join(repoDir, "index.html"))); diff != "" {
+		t.Fatalf("unexpected content after failed update (-want +got):\n%s", diff)
+	}
+}
+
+func TestManagerStopStopsLoops(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		loop func(*Repository)
+	}{
+		{name: "test auto updater", loop: autoUpdater},
+		{name: "test preview collector", loop: previewCollector},
+		{name: "test maintainer", loop: maintainer},
+		{name: "test verifier", loop: verifier},
+		{name: "test deploy key updater", loop: deployKeyUpdater},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRepository(t, &RepositoryConfig{
+				Address:             "https://github.com/authp/authp.github.io.git",
+				UpdateInterval:      3600,
+				MaintenanceInterval: 3600,
+				VerifyInterval:      3600,
+				Preview:             &PreviewConfig{TTL: 3600},
+				Webhooks: []*WebhookConfig{
+					{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"},
+				},
+			})
+			m := &Manager{repos: map[string]*Repository{r.Config.Name: r}}
+			exited := make(chan struct{})
+			go func() {
+				tc.loop(r)
+				close(exited)
+			}()
+			m.Stop()
+			select {
+			case <-exited:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected loop to exit after stop")
+			}
+		})
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	r := newTestRepository(t, &RepositoryConfig{Address: filepath.Join(t.TempDir(), "missing.git")})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected update error")
+	}
+	manager = &Manager{repos: map[string]*Repository{r.Config.Name: r}}
+	defer func() {
+		manager = nil
+	}()
+
+	statuses := Statuses()
+	if len(statuses) != 1 {
+		t.Fatalf("unexpected statuses: %v", statuses)
+	}
+	b, err := json.Marshal(statuses[0])
+	if err != nil {
+		t.Fatalf("failed marshaling status: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed unmarshaling status: %v", err)
+	}
+	if diff := cmp.Diff("test", got["repository"]); diff != "" {
+		t.Fatalf("unexpected repository (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(statuses[0].Error.Error(), got["error"]); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+}
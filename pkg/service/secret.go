@@ -0,0 +1,141 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RedactedSecret is the marker replacing the secrets in JSON and logs.
+const RedactedSecret = "REDACTED"
+
+// Secret is a password, a token, a key, or other secret of the config. The
+// secret is redacted when marshaled to JSON and when formatted, e.g. in
+// logs. The placeholder, e.g. {env.GIT_PASSWORD}, is not a secret, and is
+// marshaled as it is, until it is resolved when provisioned.
+type Secret string
+
+// IsPlaceholder checks whether the secret is a single placeholder.
+func (s Secret) IsPlaceholder() bool {
+	v := string(s)
+	return strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}") && strings.Count(v, "{") == 1 && strings.Count(v, "}") == 1
+}
+
+// MarshalJSON marshals the secret as the redacted marker, unless it is a
+// placeholder.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" || s.IsPlaceholder() {
+		return json.Marshal(string(s))
+	}
+	return json.Marshal(RedactedSecret)
+}
+
+// String returns the redacted marker.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return RedactedSecret
+}
+
+// GoString returns the redacted marker.
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// redacted checks whether the secret was read from the redacted JSON.
+func (s Secret) redacted() bool {
+	return s == RedactedSecret
+}
+
+// MarshalJSONWithSecrets marshals the config to JSON with the secrets kept
+// as they are. The Caddyfile adapter uses it, because the adapted JSON config
+// is the only copy of the literal secrets of the Caddyfile.
+func (cfg *Config) MarshalJSONWithSecrets() ([]byte, error) {
+	if len(cfg.Repositories) == 0 {
+		return json.Marshal(cfg)
+	}
+	var repos []json.RawMessage
+	for _, rc := range cfg.Repositories {
+		b, err := rc.marshalJSONWithSecrets()
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, b)
+	}
+	return json.Marshal(map[string]interface{}{"repositories": repos})
+}
+
+func (rc *RepositoryConfig) marshalJSONWithSecrets() (json.RawMessage, error) {
+	fields, err := marshalFields(rc)
+	if err != nil {
+		return nil, err
+	}
+	if rc.Auth != nil {
+		auth, err := marshalFields(rc.Auth)
+		if err != nil {
+			return nil, err
+		}
+		revealSecrets(auth, map[string]Secret{
+			"password":       rc.Auth.Password,
+			"token":          rc.Auth.Token,
+			"key_data":       rc.Auth.KeyData,
+			"key_passphrase": rc.Auth.KeyPassphrase,
+		})
+		if fields["auth"], err = json.Marshal(auth); err != nil {
+			return nil, err
+		}
+	}
+	if len(rc.Webhooks) > 0 {
+		var webhooks []map[string]json.RawMessage
+		for _, webhook := range rc.Webhooks {
+			wh, err := marshalFields(webhook)
+			if err != nil {
+				return nil, err
+			}
+			revealSecrets(wh, map[string]Secret{"secret": webhook.Secret})
+			webhooks = append(webhooks, wh)
+		}
+		if fields["webhooks"], err = json.Marshal(webhooks); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// marshalFields marshals the value to JSON object and returns its fields.
+func marshalFields(v interface{}) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// revealSecrets replaces the redacted fields with the secrets.
+func revealSecrets(fields map[string]json.RawMessage, secrets map[string]Secret) {
+	for k, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		b, _ := json.Marshal(string(secret))
+		fields[k] = b
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSecretRedaction(t *testing.T) {
+	auth := &AuthConfig{
+		Username: "foo",
+		Password: "hunter2",
+		Token:    "{env.GIT_TOKEN}",
+	}
+
+	b, err := json.Marshal(auth)
+	if err != nil {
+		t.Fatalf("failed marshaling auth config: %v", err)
+	}
+	want := `{"username":"foo","password":"REDACTED","token":"{env.GIT_TOKEN}"}`
+	if diff := cmp.Diff(want, string(b)); diff != "" {
+		t.Fatalf("unexpected json (-want +got):\n%s", diff)
+	}
+
+	for _, got := range []string{
+		fmt.Sprintf("%v %s %q %+v %#v", auth.Password, auth.Password, auth.Password, auth, auth),
+		func() string {
+			var buf bytes.Buffer
+			logger := zap.New(zapcore.NewCore(
+				zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+				zapcore.AddSync(&buf),
+				zapcore.DebugLevel,
+			))
+			logger.Info("auth", zap.Any("password", auth.Password), zap.Any("auth", auth), zap.Stringer("secret", auth.Password))
+			return buf.String()
+		}(),
+	} {
+		if strings.Contains(got, "hunter2") {
+			t.Fatalf("secret is not redacted: %s", got)
+		}
+	}
+}
+
+func TestSecretResolution(t *testing.T) {
+	t.Setenv("GIT_TEST_TOKEN", "s3cr3t")
+	cfg := NewConfig()
+	rc := &RepositoryConfig{
+		Name:     "test",
+		Address:  "https://github.com/authp/authp.github.io.git",
+		BaseDir:  t.TempDir(),
+		Auth:     &AuthConfig{Token: "{env.GIT_TEST_TOKEN}"},
+		Webhooks: []*WebhookConfig{{Name: "Github", Header: "X-Hub-Signature-256", Secret: "{env.GIT_TEST_TOKEN}"}},
+	}
+	if err := cfg.AddRepository(rc); err != nil {
+		t.Fatalf("failed adding repository: %v", err)
+	}
+	cfg.ResolveSecrets(func(s string) string {
+		if strings.HasPrefix(s, "{env.") {
+			return os.Getenv(strings.TrimSuffix(strings.TrimPrefix(s, "{env."), "}"))
+		}
+		return s
+	})
+	if diff := cmp.Diff(Secret("s3cr3t"), rc.Auth.Token); diff != "" {
+		t.Fatalf("unexpected token (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(Secret("s3cr3t"), rc.Webhooks[0].Secret); diff != "" {
+		t.Fatalf("unexpected webhook secret (-want +got):\n%s", diff)
+	}
+
+	// The redacted config is rejected, instead of authenticating with the
+	// redacted marker.
+	redacted := &RepositoryConfig{}
+	if err := json.Unmarshal([]byte(`{
+	  "name": "test",
+	  "address": "https://github.com/authp/authp.github.io.git",
+	  "base_dir": "/tmp",
+	  "auth": {"username": "foo", "password": "REDACTED"}
+	}`), redacted); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+	err := redacted.validate()
+	if err == nil || !strings.Contains(err.Error(), "password secret is redacted") {
+		t.Fatalf("expected redacted secret error, got: %v", err)
+	}
+}
+
+func TestConfigMarshalJSONWithSecrets(t *testing.T) {
+	cfg := &Config{Repositories: []*RepositoryConfig{
+		{
+			Name:     "test",
+			Address:  "https://github.com/authp/authp.github.io.git",
+			Auth:     &AuthConfig{Username: "foo", Password: "hunter2", Token: "{env.GIT_TOKEN}"},
+			Webhooks: []*WebhookConfig{{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"}},
+		},
+	}}
+
+	b, err := cfg.MarshalJSONWithSecrets()
+	if err != nil {
+		t.Fatalf("failed marshaling config: %v", err)
+	}
+	got := &Config{}
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+	if diff := cmp.Diff(Secret("hunter2"), got.Repositories[0].Auth.Password); diff != "" {
+		t.Fatalf("unexpected password (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(Secret("{env.GIT_TOKEN}"), got.Repositories[0].Auth.Token); diff != "" {
+		t.Fatalf("unexpected token (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(Secret("foobar"), got.Repositories[0].Webhooks[0].Secret); diff != "" {
+		t.Fatalf("unexpected webhook secret (-want +got):\n%s", diff)
+	}
+
+	// The regular marshaling still redacts the secrets.
+	b, err = json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("failed marshaling config: %v", err)
+	}
+	if strings.Contains(string(b), "hunter2") || strings.Contains(string(b), "foobar") {
+		t.Fatalf("secret is not redacted: %s", b)
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"go.uber.org/zap"
+	cryptossh "golang.org/x/crypto/ssh"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	pgpSignaturePrefix = "-----BEGIN PGP SIGNATURE-----"
+	sshSignaturePrefix = "-----BEGIN SSH SIGNATURE-----"
+	sshSigMagic        = "SSHSIG"
+	sshSigNamespace    = "git"
+)
+
+// allowedSigner is an entry of SSH allowed signers file.
+type allowedSigner struct {
+	principals []string
+	key        cryptossh.PublicKey
+}
+
+// signatureVerifier verifies commit signatures with the trusted keys.
+type signatureVerifier struct {
+	keyRing        string
+	allowedSigners []*allowedSigner
+}
+
+// verifyCommits verifies the signatures of the new commit, or of all the
+// commits between the old and the new commits. The trusted keys are read
+// on every verification.
+func (r *Repository) verifyCommits(repo *git.Repository, old plumbing.Hash, commit *object.Commit) error {
+	cfg := r.Config.VerifySignatures
+	if cfg == nil {
+		return nil
+	}
+	v, err := newSignatureVerifier(cfg)
+	if err != nil {
+		return err
+	}
+
+	commits := []*object.Commit{commit}
+	if cfg.Commits == verifyAllCommits && !old.IsZero() && old != commit.Hash {
+		commits, err = listNewCommits(repo, old, commit)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range commits {
+		signer, err := v.verify(c)
+		if err != nil {
+			r.logger.Warn(
+				"rejected unverified commit",
+				zap.String("repo_name", r.Config.Name),
+				zap.String("commit", c.Hash.String()),
+				zap.String("author", c.Author.Email),
+				zap.String("committer", c.Committer.Email),
+				zap.Error(err),
+			)
+			r.setRejected(c.Hash, err)
+			return fmt.Errorf("commit %s rejected: %v", c.Hash, err)
+		}
+		r.logger.Debug(
+			"verified commit signature",
+			zap.String("repo_name", r.Config.Name),
+			zap.String("commit", c.Hash.String()),
+			zap.String("signer", signer),
+		)
+	}
+	return nil
+}
+
+// verifyTip checks that the update from the old commit to the new one is a
+// fast-forward and verifies the signatures of the new commits.
+func (r *Repository) verifyTip(repo *git.Repository, old, new plumbing.Hash) (*object.Commit, error) {
+	commit, err := repo.CommitObject(new)
+	if err != nil {
+		return nil, err
+	}
+	if !old.IsZero() {
+		ff, err := isFastForward(commit, old)
+		if err != nil {
+			return nil, err
+		}
+		if !ff {
+			return nil, git.ErrNonFastForwardUpdate
+		}
+	}
+	if err := r.verifyCommits(repo, old, commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+// isFastForward checks whether the old commit is reachable from the new one.
+func isFastForward(commit *object.Commit, old plumbing.Hash) (bool, error) {
+	found := false
+	iter := object.NewCommitPreorderIter(commit, nil, nil)
+	err := iter.ForEach(func(c *object.Commit) error {
+		if c.Hash != old {
+			return nil
+		}
+		found = true
+		return storer.ErrStop
+	})
+	if err == plumbing.ErrObjectNotFound {
+		// The truncated history of a shallow clone ends before the old
+		// commit, so the update is not known to be a fast-forward.
+		return false, fmt.Errorf("commit %s is not reachable within the fetched history", old)
+	}
+	return found, err
+}
+
+// listNewCommits returns the commits reachable from the new commit, but not
+// from the old one.
+func listNewCommits(repo *git.Repository, old plumbing.Hash, commit *object.Commit) ([]*object.Commit, error) {
+	ignore := []plumbing.Hash{old}
+	if oldCommit, err := repo.CommitObject(old); err == nil {
+		if bases, err := commit.MergeBase(oldCommit); err == nil {
+			for _, base := range bases {
+				ignore = append(ignore, base.Hash)
+			}
+		}
+	}
+	var commits []*object.Commit
+	iter := object.NewCommitPreorderIter(commit, nil, ignore)
+	err := iter.ForEach(func(c *object.Commit) error {
+		commits = append(commits, c)
+		return nil
+	})
+	if err == plumbing.ErrObjectNotFound {
+		// The unverified commits are beyond the truncated history.
+		return nil, fmt.Errorf("new commits are not reachable within the fetched history")
+	}
+	if err != nil && err != storer.ErrStop {
+		return nil, err
+	}
+	return commits, nil
+}
+
+func newSignatureVerifier(cfg *SignatureConfig) (*signatureVerifier, error) {
+	v := &signatureVerifier{}
+	var keyRing []string
+	for _, fp := range cfg.GPGKeys {
+		b, err := os.ReadFile(expandDir(fp))
+		if err != nil {
+			return nil, err
+		}
+		keyRing = append(keyRing, string(b))
+	}
+	v.keyRing = strings.Join(keyRing, "\n")
+	if cfg.AllowedSigners != "" {
+		signers, err := readAllowedSigners(expandDir(cfg.AllowedSigners))
+		if err != nil {
+			return nil, err
+		}
+		v.allowedSigners = signers
+	}
+	return v, nil
+}
+
+// verify verifies the signature of the commit and returns the signer.
+func (v *signatureVerifier) verify(c *object.Commit) (string, error) {
+	sig := strings.TrimSpace(c.PGPSignature)
+	switch {
+	case sig == "":
+		return "", fmt.Errorf("commit is not signed")
+	case strings.HasPrefix(sig, pgpSignaturePrefix):
+		if v.keyRing == "" {
+			return "", fmt.Errorf("no trusted openpgp keys")
+		}
+		entity, err := c.Verify(v.keyRing)
+		if err != nil {
+			return "", err
+		}
+		for name := range entity.Identities {
+			return name, nil
+		}
+		return entity.PrimaryKey.KeyIdString(), nil
+	case strings.HasPrefix(sig, sshSignaturePrefix):
+		if len(v.allowedSigners) == 0 {
+			return "", fmt.Errorf("no trusted ssh signers")
+		}
+		msg, err := encodeCommitWithoutSignature(c)
+		if err != nil {
+			return "", err
+		}
+		key, err := verifySSHSignature(sig, msg, sshSigNamespace)
+		if err != nil {
+			return "", err
+		}
+		for _, signer := range v.allowedSigners {
+			if !bytes.Equal(signer.key.Marshal(), key.Marshal()) {
+				continue
+			}
+			for _, principal := range signer.principals {
+				if matched, _ := path.Match(principal, c.Committer.Email); matched {
+					return c.Committer.Email, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("ssh signer %s is not allowed for %s", cryptossh.FingerprintSHA256(key), c.Committer.Email)
+	}
+	return "", fmt.Errorf("unsupported signature format")
+}
+
+func encodeCommitWithoutSignature(c *object.Commit) ([]byte, error) {
+	obj := &plumbing.MemoryObject{}
+	if err := c.EncodeWithoutSignature(obj); err != nil {
+		return nil, err
+	}
+	rd, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// verifySSHSignature verifies the armored SSH signature of the message, see
+// PROTOCOL.sshsig of OpenSSH, and returns the public key of the signer.
+func verifySSHSignature(armored string, msg []byte, namespace string) (cryptossh.PublicKey, error) {
+	block, _ := pem.Decode([]byte(armored))
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, fmt.Errorf("malformed ssh signature")
+	}
+	b := block.Bytes
+	if !bytes.HasPrefix(b, []byte(sshSigMagic)) || len(b) < len(sshSigMagic)+4 {
+		return nil, fmt.Errorf("malformed ssh signature preamble")
+	}
+	b = b[len(sshSigMagic):]
+	if version := binary.BigEndian.Uint32(b); version != 1 {
+		return nil, fmt.Errorf("unsupported ssh signature version %d", version)
+	}
+	b = b[4:]
+
+	var fields [5][]byte
+	for i := range fields {
+		var ok bool
+		if fields[i], b, ok = parseSSHString(b); !ok {
+			return nil, fmt.Errorf("malformed ssh signature")
+		}
+	}
+	pubKeyBytes, sigNamespace, reserved, hashAlg, sigBytes := fields[0], fields[1], fields[2], fields[3], fields[4]
+	if string(sigNamespace) != namespace {
+		return nil, fmt.Errorf("ssh signature namespace %q mismatch", sigNamespace)
+	}
+
+	var h hash.Hash
+	switch string(hashAlg) {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported ssh signature hash algorithm %q", hashAlg)
+	}
+	h.Write(msg)
+
+	pubKey, err := cryptossh.ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	sig := &cryptossh.Signature{}
+	if err := cryptossh.Unmarshal(sigBytes, sig); err != nil {
+		return nil, err
+	}
+
+	var signed bytes.Buffer
+	signed.WriteString(sshSigMagic)
+	for _, field := range [][]byte{sigNamespace, reserved, hashAlg, h.Sum(nil)} {
+		writeSSHString(&signed, field)
+	}
+	if err := pubKey.Verify(signed.Bytes(), sig); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
+
+func parseSSHString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, false
+	}
+	return b[4 : 4+n], b[4+n:], true
+}
+
+func writeSSHString(buf *bytes.Buffer, s []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+	buf.Write(n[:])
+	buf.Write(s)
+}
+
+// readAllowedSigners reads SSH allowed signers file, see ssh-keygen(1).
+func readAllowedSigners(fp string) ([]*allowedSigner, error) {
+	fh, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var signers []*allowedSigner
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed allowed signers entry: %s", line)
+		}
+		principals := strings.Split(fields[0], ",")
+		rest := strings.Join(fields[1:], " ")
+		// The key may be preceded by options.
+		if !strings.HasPrefix(fields[1], "ssh-") && !strings.HasPrefix(fields[1], "ecdsa-") && !strings.HasPrefix(fields[1], "sk-") {
+			if strings.Contains(fields[1], "cert-authority") {
+				// The cert-authority entries are not supported.
+				continue
+			}
+			rest = strings.Join(fields[2:], " ")
+		}
+		key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return nil, fmt.Errorf("malformed allowed signers entry: %s: %v", line, err)
+		}
+		signers = append(signers, &allowedSigner{principals: principals, key: key})
+	}
+	return signers, scanner.Err()
+}
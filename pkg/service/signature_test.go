@@ -0,0 +1,321 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/google/go-cmp/cmp"
+)
+
+// newTestSignKey creates OpenPGP key and writes its armored public key
+// into a file.
+func newTestSignKey(t *testing.T, name string) (*openpgp.Entity, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", name+"@localhost", nil)
+	if err != nil {
+		t.Fatalf("failed generating openpgp key: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("failed encoding openpgp key: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("failed serializing openpgp key: %v", err)
+	}
+	w.Close()
+	fp := filepath.Join(t.TempDir(), name+".asc")
+	if err := os.WriteFile(fp, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed writing openpgp key: %v", err)
+	}
+	return entity, fp
+}
+
+func TestRepositoryVerifySignatures(t *testing.T) {
+	trusted, trustedKeyPath := newTestSignKey(t, "trusted")
+	untrusted, _ := newTestSignKey(t, "untrusted")
+
+	for _, tc := range []struct {
+		name    string
+		deploy  string
+		commits string
+		// The keys signing the second and the third commits.
+		signKeys     []*openpgp.Entity
+		want         string
+		wantRejected int
+	}{
+		{
+			name:     "test signed commits",
+			signKeys: []*openpgp.Entity{trusted, trusted},
+			want:     "v3",
+		},
+		{
+			name:         "test unsigned head commit",
+			signKeys:     []*openpgp.Entity{trusted, nil},
+			want:         "v1",
+			wantRejected: 2,
+		},
+		{
+			name:         "test head commit signed with untrusted key",
+			signKeys:     []*openpgp.Entity{trusted, untrusted},
+			want:         "v1",
+			wantRejected: 2,
+		},
+		{
+			name:     "test unsigned intermediate commit",
+			signKeys: []*openpgp.Entity{nil, trusted},
+			want:     "v3",
+		},
+		{
+			name:         "test unsigned intermediate commit with all commits verified",
+			commits:      "all",
+			signKeys:     []*openpgp.Entity{nil, trusted},
+			want:         "v1",
+			wantRejected: 1,
+		},
+		{
+			name:         "test unsigned head commit with export",
+			deploy:       "export",
+			signKeys:     []*openpgp.Entity{trusted, nil},
+			want:         "v1",
+			wantRejected: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.signKey = trusted
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address: upstream.bareDir,
+				Branch:  "master",
+				Deploy:  tc.deploy,
+				VerifySignatures: &SignatureConfig{
+					GPGKeys: []string{trustedKeyPath},
+					Commits: tc.commits,
+				},
+			})
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+
+			var hashes []string
+			for i, content := range []string{"v2", "v3"} {
+				upstream.signKey = tc.signKeys[i]
+				upstream.commit("update", map[string][]byte{"index.html": []byte(content)})
+				head, _ := upstream.repo.Head()
+				hashes = append(hashes, head.Hash().String())
+			}
+
+			err := r.update()
+			if tc.wantRejected > 0 && err == nil {
+				t.Fatalf("expected update to fail")
+			}
+			if tc.wantRejected == 0 && err != nil {
+				t.Fatalf("failed updating repo: %v", err)
+			}
+
+			fp := filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+			if diff := cmp.Diff(tc.want, readTestFile(t, fp)); diff != "" {
+				t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+			}
+			var wantRejected string
+			if tc.wantRejected > 0 {
+				wantRejected = hashes[tc.wantRejected-1]
+			}
+			if diff := cmp.Diff(wantRejected, r.Status().RejectedCommit); diff != "" {
+				t.Fatalf("unexpected rejected commit (-want +got):\n%s", diff)
+			}
+
+			// The rejected commit stays rejected.
+			if err := r.update(); (err != nil) != (tc.wantRejected > 0) {
+				t.Fatalf("unexpected repeated update result: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, readTestFile(t, fp)); diff != "" {
+				t.Fatalf("unexpected content after repeated update (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryVerifySignaturesInitialClone(t *testing.T) {
+	_, trustedKeyPath := newTestSignKey(t, "trusted")
+	for _, deploy := range []string{"checkout", "export"} {
+		t.Run("test unsigned clone with "+deploy+" deployment", func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address:          upstream.bareDir,
+				Branch:           "master",
+				Deploy:           deploy,
+				VerifySignatures: &SignatureConfig{GPGKeys: []string{trustedKeyPath}},
+			})
+			head, _ := upstream.repo.Head()
+			want := fmt.Sprintf("commit %s rejected: commit is not signed", head.Hash())
+			for i := 0; i < 2; i++ {
+				err := r.update()
+				if diff := cmp.Diff(want, fmt.Sprint(err)); diff != "" {
+					t.Fatalf("unexpected update error (-want +got):\n%s", diff)
+				}
+				fp := filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+				if _, err := os.Stat(fp); !os.IsNotExist(err) {
+					t.Fatalf("expected rejected commit not to be deployed, got: %v", err)
+				}
+				if deploy != "checkout" {
+					continue
+				}
+				if _, err := os.Stat(filepath.Join(r.Config.BaseDir, r.Config.Name)); !os.IsNotExist(err) {
+					t.Fatalf("expected rejected clone to be removed, got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRepositoryVerifySignaturesShallow(t *testing.T) {
+	trusted, trustedKeyPath := newTestSignKey(t, "trusted")
+	upstream := newTestUpstream(t)
+	upstream.signKey = trusted
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+
+	r := newTestRepository(t, &RepositoryConfig{
+		Address:          upstream.bareDir,
+		Branch:           "master",
+		Depth:            1,
+		VerifySignatures: &SignatureConfig{GPGKeys: []string{trustedKeyPath}},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+
+	// The old commit is beyond the depth of the fetched history.
+	upstream.commit("update", map[string][]byte{"index.html": []byte("v2")})
+	upstream.commit("update", map[string][]byte{"index.html": []byte("v3")})
+	if err := r.update(); err == nil {
+		t.Fatalf("expected update to fail")
+	}
+	fp := filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+	if diff := cmp.Diff("v1", readTestFile(t, fp)); diff != "" {
+		t.Fatalf("unexpected content after update (-want +got):\n%s", diff)
+	}
+
+	rc := NewRepositoryConfig()
+	rc.Name = "foo"
+	rc.Address = upstream.bareDir
+	rc.Depth = 1
+	rc.VerifySignatures = &SignatureConfig{GPGKeys: []string{trustedKeyPath}, Commits: "all"}
+	want := "repository config verify_signatures commits all is unsupported with depth"
+	if diff := cmp.Diff(want, fmt.Sprint(rc.validate())); diff != "" {
+		t.Fatalf("unexpected validation error (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryVerifySSHSignatures(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	rootDir := t.TempDir()
+	keyPath := filepath.Join(rootDir, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyPath).CombinedOutput(); err != nil {
+		t.Fatalf("failed generating ssh key: %v: %s", err, out)
+	}
+	pubKey, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatalf("failed reading ssh key: %v", err)
+	}
+
+	workDir := filepath.Join(rootDir, "work")
+	runGit := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{
+			"-c", "user.name=Test",
+			"-c", "user.email=test@localhost",
+			"-c", "gpg.format=ssh",
+			"-c", "user.signingkey=" + keyPath,
+		}, args...)...)
+		cmd.Dir = workDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("failed running git %v: %v: %s", args, err, out)
+		}
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		t.Fatalf("failed creating work dir: %v", err)
+	}
+	runGit("init", "-q", "-b", "master")
+	if err := os.WriteFile(filepath.Join(workDir, "index.html"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("failed writing file: %v", err)
+	}
+	runGit("add", "index.html")
+	runGit("commit", "-q", "-S", "-m", "initial commit")
+
+	for _, tc := range []struct {
+		name           string
+		allowedSigners string
+		shouldErr      bool
+	}{
+		{
+			name:           "test allowed signer",
+			allowedSigners: "test@localhost " + string(pubKey),
+		},
+		{
+			name:           "test allowed signer with wildcard principal",
+			allowedSigners: "*@localhost namespaces=\"git\" " + string(pubKey),
+		},
+		{
+			name:           "test signer allowed for other principal",
+			allowedSigners: "admin@localhost " + string(pubKey),
+			shouldErr:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fp := filepath.Join(t.TempDir(), "allowed_signers")
+			if err := os.WriteFile(fp, []byte(tc.allowedSigners), 0644); err != nil {
+				t.Fatalf("failed writing allowed signers: %v", err)
+			}
+			r := newTestRepository(t, &RepositoryConfig{
+				Address:          workDir,
+				Branch:           "master",
+				VerifySignatures: &SignatureConfig{AllowedSigners: fp},
+			})
+			err := r.update()
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected update to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+			fp = filepath.Join(r.Config.BaseDir, r.Config.Name, "index.html")
+			if diff := cmp.Diff("v1", readTestFile(t, fp)); diff != "" {
+				t.Fatalf("unexpected content after clone (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -14,8 +14,121 @@
 
 package service
 
+import (
+	"encoding/json"
+	"github.com/go-git/go-git/v5/plumbing"
+	"time"
+)
+
 // Status represent the last recorded status of a git repository.
 type Status struct {
-	Repository string `json:"repository,omitempty"`
-	Error      error  `json:"error,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+	Error      error     `json:"error,omitempty"`
+	// The last commit rejected by the signature verification or the symlinks
+	// policy.
+	RejectedCommit string `json:"rejected_commit,omitempty"`
+	// The reason the commit was rejected for.
+	RejectedReason string `json:"rejected_reason,omitempty"`
+	// The time of the last maintenance.
+	MaintainedAt time.Time `json:"maintained_at,omitempty"`
+	// The disk space used by the repository metadata after the maintenance.
+	DiskBytes int64 `json:"disk_bytes,omitempty"`
+	// The disk space reclaimed by the last maintenance.
+	ReclaimedBytes int64 `json:"reclaimed_bytes,omitempty"`
+	// The time of the last verification of the worktree.
+	VerifiedAt time.Time `json:"verified_at,omitempty"`
+	// The changes of the worktree found by the last verification.
+	Tampered *TamperReport `json:"tampered,omitempty"`
+	// Whether the changes found by the last verification were reverted.
+	Repaired bool `json:"repaired,omitempty"`
+	// The expiry of the SSH certificate used by the last update.
+	CertificateExpiresAt time.Time `json:"certificate_expires_at,omitempty"`
+	// The public deploy key generated for the repository.
+	DeployKey string `json:"deploy_key,omitempty"`
+	// Whether the updates wait for the deploy key to be added to the remote.
+	DeployKeyPending bool `json:"deploy_key_pending,omitempty"`
+}
+
+// MarshalJSON marshals the status with the error of the last update as
+// the message.
+func (s *Status) MarshalJSON() ([]byte, error) {
+	type status Status
+	v := struct {
+		*status
+		Error string `json:"error,omitempty"`
+	}{status: (*status)(s)}
+	if s.Error != nil {
+		v.Error = s.Error.Error()
+	}
+	return json.Marshal(v)
+}
+
+// Status returns the last recorded status of the Repository.
+func (r *Repository) Status() *Status {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	status := r.status
+	status.Repository = r.Config.Name
+	return &status
+}
+
+// setStatus records the outcome of an update.
+func (r *Repository) setStatus(err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.UpdatedAt = time.Now().UTC()
+	r.status.Error = err
+	if err == nil {
+		r.status.RejectedCommit = ""
+		r.status.RejectedReason = ""
+		r.status.DeployKeyPending = false
+	}
+}
+
+// setRejected records the commit rejected before the deployment.
+func (r *Repository) setRejected(h plumbing.Hash, err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.RejectedCommit = h.String()
+	r.status.RejectedReason = err.Error()
+}
+
+// setMaintained records the outcome of a maintenance.
+func (r *Repository) setMaintained(size, reclaimed int64) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.MaintainedAt = time.Now().UTC()
+	r.status.DiskBytes = size
+	r.status.ReclaimedBytes = reclaimed
+}
+
+// setVerified records the outcome of a verification of the worktree.
+func (r *Repository) setVerified(report *TamperReport, repaired bool) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.VerifiedAt = time.Now().UTC()
+	r.status.Tampered = report
+	r.status.Repaired = repaired
+}
+
+// setCertificateExpiry records the expiry of the SSH certificate.
+func (r *Repository) setCertificateExpiry(expiresAt time.Time) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.CertificateExpiresAt = expiresAt
+}
+
+// setDeployKey records the public deploy key.
+func (r *Repository) setDeployKey(publicKey string) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.DeployKey = publicKey
+}
+
+// setDeployKeyPending records the update waiting for the deploy key.
+func (r *Repository) setDeployKeyPending() {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.status.DeployKeyPending = true
 }
@@ -0,0 +1,179 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+)
+
+// repositoryExists checks whether the repository has been cloned already.
+func (r *Repository) repositoryExists(repoDir string) (bool, error) {
+	if r.Config.GitDir != "" {
+		return dirExists(r.Config.GitDir)
+	}
+	return dirExists(repoDir)
+}
+
+// cloneRepository clones the repository into repoDir. When GitDir is
+// configured, the repository metadata is stored there instead of the
+// .git directory inside repoDir.
+func (r *Repository) cloneRepository(repoDir string, opts *git.CloneOptions) (*git.Repository, error) {
+	gitDir := r.checkoutGitDir(repoDir)
+	// Only the directories created by the clone are removed when it fails.
+	var created []string
+	for _, dir := range []string{repoDir, gitDir} {
+		exists, err := dirExists(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			created = append(created, dir)
+		}
+	}
+	if err := os.MkdirAll(gitDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		return nil, err
+	}
+	repo, err := git.Clone(r.newStorage(gitDir), osfs.New(repoDir), opts)
+	if err != nil {
+		// The partial worktree and metadata break the next attempt.
+		for _, dir := range created {
+			os.RemoveAll(dir)
+		}
+		return nil, err
+	}
+	if r.Config.GitDir != "" {
+		// The clone leaves the "gitdir: <path>" pointer file in the
+		// worktree. It is not needed, because the storage is always
+		// opened explicitly.
+		if err := os.Remove(filepath.Join(repoDir, git.GitDirName)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// migrateGitDir moves the .git directory of the existing checkout in repoDir
+// into GitDir, when GitDir is added to the config of the checkout. The
+// checkout is kept, and the next update fetches into the moved repository.
+func (r *Repository) migrateGitDir(repoDir string) error {
+	if r.Config.GitDir == "" || r.Config.Mode == modeMirror || r.Config.Deploy == deployExport || len(r.Config.Branches) > 0 {
+		return nil
+	}
+	inTreeDir := filepath.Join(repoDir, git.GitDirName)
+	fi, err := os.Lstat(inTreeDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		// The "gitdir: <path>" pointer file.
+		return nil
+	}
+	gitDir := expandDir(r.Config.GitDir)
+	exists, err := dirExists(gitDir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("repository in %s conflicts with git_dir %s", inTreeDir, gitDir)
+	}
+	if err := os.MkdirAll(filepath.Dir(gitDir), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(inTreeDir, gitDir); err != nil {
+		return fmt.Errorf("failed moving %s to git_dir: %v", inTreeDir, err)
+	}
+	r.logger.Info(
+		"moved repository metadata to git_dir",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("git_dir", gitDir),
+	)
+	return nil
+}
+
+// openRepository opens the repository cloned into repoDir.
+func (r *Repository) openRepository(repoDir string) (*git.Repository, error) {
+	repoDir, err := filepath.Abs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(r.newStorage(r.checkoutGitDir(repoDir)), osfs.New(repoDir))
+}
+
+// metadataDir returns the directory holding the metadata of the Repository.
+func (r *Repository) metadataDir() string {
+	repoDir := filepath.Join(expandDir(r.Config.BaseDir), r.Config.Name)
+	switch {
+	case r.Config.Mode == modeMirror:
+		return repoDir
+	case r.Config.Deploy == deployExport || len(r.Config.Branches) > 0:
+		return r.exportGitDir(repoDir)
+	}
+	return r.checkoutGitDir(repoDir)
+}
+
+// checkoutGitDir returns the directory of the repository metadata of the
+// checkout in repoDir.
+func (r *Repository) checkoutGitDir(repoDir string) string {
+	if r.Config.GitDir != "" {
+		return expandDir(r.Config.GitDir)
+	}
+	return filepath.Join(repoDir, git.GitDirName)
+}
+
+// cloneBare clones the repository into a bare gitDir.
+func (r *Repository) cloneBare(gitDir string, opts *git.CloneOptions) (*git.Repository, error) {
+	repo, err := git.Clone(r.newStorage(gitDir), nil, opts)
+	if err != nil {
+		os.RemoveAll(gitDir)
+		return nil, err
+	}
+	return repo, nil
+}
+
+// openBare opens the bare repository in gitDir.
+func (r *Repository) openBare(gitDir string) (*git.Repository, error) {
+	return git.Open(r.newStorage(gitDir), nil)
+}
+
+// initBare initializes a bare repository in gitDir.
+func (r *Repository) initBare(gitDir string) (*git.Repository, error) {
+	return git.Init(r.newStorage(gitDir), nil)
+}
+
+// newStorage returns the storage of the repository metadata in gitDir. The
+// memory used by the cache of objects and by the objects read from the
+// packfiles is bounded by the configuration.
+func (r *Repository) newStorage(gitDir string) *filesystem.Storage {
+	objectCache := cache.NewObjectLRUDefault()
+	if r.Config.CacheSize > 0 {
+		objectCache = cache.NewObjectLRU(cache.FileSize(r.Config.CacheSize))
+	}
+	return filesystem.NewStorageWithOptions(osfs.New(gitDir), objectCache, filesystem.Options{
+		LargeObjectThreshold: r.Config.LargeObjectThreshold,
+	})
+}
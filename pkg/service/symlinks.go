@@ -0,0 +1,217 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinkHops is the maximum number of symlinks followed while
+// resolving a path, see MAXSYMLINKS of Linux.
+const maxSymlinkHops = 40
+
+// treeSymlink is a symlink entry of a tree.
+type treeSymlink struct {
+	name   string
+	target string
+}
+
+// restrictsSymlinks checks whether the trees are inspected for symlinks
+// before being deployed.
+func (r *Repository) restrictsSymlinks() bool {
+	return r.Config.Symlinks == symlinksDeny || r.Config.Symlinks == symlinksWithinRepo
+}
+
+// checkSymlinks checks the symlinks of the tree of the commit against the
+// configured policy before the tree is deployed.
+func (r *Repository) checkSymlinks(commit *object.Commit) error {
+	if !r.restrictsSymlinks() {
+		return nil
+	}
+	return r.checkSymlinksPolicy(commit, r.Config.Symlinks)
+}
+
+// checkPreviewSymlinks checks the symlinks of the tree of the previewed
+// commit. The previews are built from untrusted pull requests, so at least
+// within_repo policy applies regardless of the configured one.
+func (r *Repository) checkPreviewSymlinks(commit *object.Commit) error {
+	policy := r.Config.Symlinks
+	if policy != symlinksDeny {
+		policy = symlinksWithinRepo
+	}
+	return r.checkSymlinksPolicy(commit, policy)
+}
+
+// checkSymlinksPolicy checks the symlinks of the tree of the commit against
+// the policy. With within_repo policy, the symlinks must resolve inside the
+// repository and inside the published directories.
+func (r *Repository) checkSymlinksPolicy(commit *object.Commit, policy string) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	links, err := collectSymlinks(tree)
+	if err != nil || len(links) == 0 {
+		return err
+	}
+
+	var violation error
+	if policy == symlinksDeny {
+		violation = fmt.Errorf("symlink %s is denied", links[0].name)
+	} else {
+		roots := []string{""}
+		for _, entry := range r.Config.Publish {
+			if src := path.Clean(strings.Trim(entry.Source, "/")); src != "." {
+				roots = append(roots, src)
+			}
+		}
+		targets := make(map[string]string)
+		for _, link := range links {
+			targets[link.name] = link.target
+		}
+		denied := r.symlinkDeniedDirs()
+	check:
+		for _, root := range roots {
+			for _, link := range links {
+				if root != "" && !strings.HasPrefix(link.name, root+"/") {
+					continue
+				}
+				if resolvesWithin(targets, root, link.name, denied) {
+					continue
+				}
+				if root == "" {
+					violation = fmt.Errorf("symlink %s -> %s escapes the repository", link.name, link.target)
+				} else {
+					violation = fmt.Errorf("symlink %s -> %s escapes the published directory %s", link.name, link.target, root)
+				}
+				break check
+			}
+		}
+	}
+	if violation == nil {
+		return nil
+	}
+
+	r.logger.Warn(
+		"rejected commit with symlinks",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("commit", commit.Hash.String()),
+		zap.String("symlinks", policy),
+		zap.Error(violation),
+	)
+	r.setRejected(commit.Hash, violation)
+	return fmt.Errorf("commit %s rejected: %v", commit.Hash, violation)
+}
+
+// collectSymlinks returns the symlinks of the tree in the tree order.
+func collectSymlinks(tree *object.Tree) ([]*treeSymlink, error) {
+	var links []*treeSymlink
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Symlink {
+			continue
+		}
+		f, err := tree.File(name)
+		if err != nil {
+			return nil, err
+		}
+		target, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, &treeSymlink{name: name, target: target})
+	}
+	return links, nil
+}
+
+// resolvesWithin resolves the symlink of the tree, following the symlinks
+// it points through, and checks that the resolved path stays inside the
+// root directory of the tree. The absolute targets never do. The paths
+// through .git, or through the denied directories of the tree, are
+// rejected too, because they expose the git metadata.
+func resolvesWithin(targets map[string]string, root, name string, denied []string) bool {
+	var rootParts int
+	if root != "" {
+		rootParts = len(strings.Split(root, "/"))
+	}
+	var current []string
+	if dir := path.Dir(name); dir != "." {
+		current = strings.Split(dir, "/")
+	}
+	target := targets[name]
+	if path.IsAbs(target) {
+		return false
+	}
+	pending := strings.Split(target, "/")
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(current) <= rootParts {
+				return false
+			}
+			current = current[:len(current)-1]
+			continue
+		}
+		current = append(current, part)
+		if strings.EqualFold(part, git.GitDirName) || isExcludedPath(strings.Join(current, "/"), denied) {
+			return false
+		}
+		next, isLink := targets[strings.Join(current, "/")]
+		if !isLink {
+			continue
+		}
+		if hops++; hops > maxSymlinkHops || path.IsAbs(next) {
+			return false
+		}
+		current = current[:len(current)-1]
+		pending = append(strings.Split(next, "/"), pending...)
+	}
+	return true
+}
+
+// symlinkDeniedDirs returns the git directory relative to the worktree, when
+// the directory is configured inside the worktree.
+func (r *Repository) symlinkDeniedDirs() []string {
+	if r.Config.GitDir == "" {
+		return nil
+	}
+	repoDir := filepath.Join(expandDir(r.Config.BaseDir), r.Config.Name)
+	rel, err := filepath.Rel(repoDir, expandDir(r.Config.GitDir))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	return []string{filepath.ToSlash(rel)}
+}
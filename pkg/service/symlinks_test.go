@@ -0,0 +1,252 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-cmp/cmp"
+)
+
+// symlink commits the symlink to the work repository and pushes it.
+func (u *testUpstream) symlink(name, target string) {
+	u.t.Helper()
+	fp := filepath.Join(u.workDir, name)
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		u.t.Fatalf("failed creating directory for %s: %v", name, err)
+	}
+	if err := os.Symlink(target, fp); err != nil {
+		u.t.Fatalf("failed creating symlink %s: %v", name, err)
+	}
+	w, err := u.repo.Worktree()
+	if err != nil {
+		u.t.Fatalf("failed opening upstream worktree: %v", err)
+	}
+	if _, err := w.Add(name); err != nil {
+		u.t.Fatalf("failed adding %s: %v", name, err)
+	}
+	_, err = w.Commit("add "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@localhost", When: time.Now()},
+	})
+	if err != nil {
+		u.t.Fatalf("failed committing: %v", err)
+	}
+	u.push()
+}
+
+func TestResolvesWithin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		root    string
+		link    string
+		targets map[string]string
+		denied  []string
+		want    bool
+	}{
+		{
+			name:    "test sibling file",
+			link:    "latest",
+			targets: map[string]string{"latest": "docs/v2"},
+			want:    true,
+		},
+		{
+			name:    "test parent directory inside repository",
+			link:    "docs/assets",
+			targets: map[string]string{"docs/assets": "../assets"},
+			want:    true,
+		},
+		{
+			name:    "test absolute target",
+			link:    "public/secrets",
+			targets: map[string]string{"public/secrets": "/etc"},
+		},
+		{
+			name:    "test parent directory outside repository",
+			link:    "public/secrets",
+			targets: map[string]string{"public/secrets": "../../etc"},
+		},
+		{
+			name: "test escape via another symlink",
+			link: "public/secrets",
+			targets: map[string]string{
+				"public/secrets": "deep/..",
+				"public/deep":    "../..",
+			},
+		},
+		{
+			name: "test resolution via another symlink",
+			link: "public/logo.png",
+			targets: map[string]string{
+				"public/logo.png": "assets/../logo.png",
+				"public/assets":   "../static/images",
+			},
+			want: true,
+		},
+		{
+			name: "test symlink loop",
+			link: "a",
+			targets: map[string]string{
+				"a": "b/x",
+				"b": "a/x",
+			},
+		},
+		{
+			name:    "test escape of published directory",
+			root:    "sites/docs",
+			link:    "sites/docs/blog",
+			targets: map[string]string{"sites/docs/blog": "../blog"},
+		},
+		{
+			name:    "test git directory",
+			link:    "cfg",
+			targets: map[string]string{"cfg": ".git/config"},
+		},
+		{
+			name:    "test git directory via parent directory",
+			link:    "public/cfg",
+			targets: map[string]string{"public/cfg": "../.GIT/config"},
+		},
+		{
+			name:    "test git directory inside worktree",
+			link:    "public/cfg",
+			targets: map[string]string{"public/cfg": "../gitdata/config"},
+			denied:  []string{"gitdata"},
+		},
+		{
+			name:    "test published directory",
+			root:    "sites/docs",
+			link:    "sites/docs/index.html",
+			targets: map[string]string{"sites/docs/index.html": "v2/index.html"},
+			want:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := resolvesWithin(tc.targets, tc.root, tc.link, tc.denied)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("unexpected result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryUpdateSymlinks(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		deploy   string
+		symlinks string
+		// The symlink committed before the first update.
+		initial []string
+		// The symlink committed before the second update.
+		update    []string
+		shouldErr bool
+	}{
+		{
+			name:     "test checkout allows symlink within repository",
+			symlinks: "within_repo",
+			update:   []string{"public/latest", "../docs"},
+		},
+		{
+			name:      "test checkout rejects escaping symlink",
+			symlinks:  "within_repo",
+			update:    []string{"public/secrets", "/etc"},
+			shouldErr: true,
+		},
+		{
+			name:      "test export rejects escaping symlink",
+			deploy:    "export",
+			symlinks:  "within_repo",
+			update:    []string{"public/secrets", "../../etc"},
+			shouldErr: true,
+		},
+		{
+			name:      "test checkout rejects symlink into git directory",
+			symlinks:  "within_repo",
+			update:    []string{"cfg", ".git/config"},
+			shouldErr: true,
+		},
+		{
+			name:      "test checkout denies symlink",
+			symlinks:  "deny",
+			update:    []string{"public/latest", "../docs"},
+			shouldErr: true,
+		},
+		{
+			name:      "test clone rejects escaping symlink",
+			symlinks:  "within_repo",
+			initial:   []string{"public/secrets", "/etc"},
+			shouldErr: true,
+		},
+		{
+			name:   "test checkout allows any symlink by default",
+			update: []string{"public/secrets", "/etc"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{
+				"public/index.html": []byte("v1"),
+				"docs/index.html":   []byte("docs"),
+			})
+			if tc.initial != nil {
+				upstream.symlink(tc.initial[0], tc.initial[1])
+			}
+
+			r := newTestRepository(t, &RepositoryConfig{
+				Address:  upstream.bareDir,
+				Deploy:   tc.deploy,
+				Symlinks: tc.symlinks,
+			})
+			repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+			link := tc.update
+			err := r.update()
+			if tc.initial != nil {
+				link = tc.initial
+			} else {
+				if err != nil {
+					t.Fatalf("failed cloning repo: %v", err)
+				}
+				upstream.symlink(tc.update[0], tc.update[1])
+				err = r.update()
+			}
+
+			_, statErr := os.Lstat(filepath.Join(repoDir, filepath.FromSlash(link[0])))
+			if !tc.shouldErr {
+				if err != nil {
+					t.Fatalf("failed updating repo: %v", err)
+				}
+				if statErr != nil {
+					t.Fatalf("expected symlink deployed, got: %v", statErr)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "rejected") {
+				t.Fatalf("expected rejected commit error, got: %v", err)
+			}
+			if !os.IsNotExist(statErr) {
+				t.Fatalf("expected symlink not deployed, got: %v", statErr)
+			}
+			head, _ := upstream.repo.Head()
+			if diff := cmp.Diff(head.Hash().String(), r.Status().RejectedCommit); diff != "" {
+				t.Fatalf("unexpected rejected commit (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/greenpau/caddy-git/pkg/errors"
+	"strings"
+)
+
+// The transports supported by RepositoryConfig.
+const (
+	transportHTTP  = "http"
+	transportHTTPS = "https"
+	transportSSH   = "ssh"
+	transportSCP   = "scp"
+	transportGit   = "git"
+	transportFile  = "file"
+)
+
+// parseAddress parses the address of a repository and detects its transport.
+// The supported formats are http(s)://, ssh://, scp-like user@host:path,
+// git://, file:// and local filesystem paths.
+func parseAddress(s string) (string, *transport.Endpoint, error) {
+	ep, err := transport.NewEndpoint(s)
+	if err != nil {
+		return "", nil, errors.ErrRepositoryConfigAddressMalformed.WithArgs(s, err)
+	}
+	switch ep.Protocol {
+	case transportHTTP, transportHTTPS, transportGit, transportFile:
+		return ep.Protocol, ep, nil
+	case transportSSH:
+		if !strings.HasPrefix(s, "ssh://") {
+			return transportSCP, ep, nil
+		}
+		return transportSSH, ep, nil
+	}
+	return "", nil, errors.ErrRepositoryConfigAddressUnsupported.WithArgs(s)
+}
+
+func isHTTPTransport(s string) bool {
+	return s == transportHTTP || s == transportHTTPS
+}
+
+func isSSHTransport(s string) bool {
+	return s == transportSSH || s == transportSCP
+}
+
+// cloneURL returns the address of the repository passed to the transport.
+func (rc *RepositoryConfig) cloneURL() string {
+	if rc.transport == transportFile {
+		return expandDir(rc.Address)
+	}
+	return rc.Address
+}
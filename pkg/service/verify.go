@@ -0,0 +1,300 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TamperReport lists the paths of the worktree differing from the tree of
+// the deployed commit.
+type TamperReport struct {
+	// The untracked files.
+	Added []string `json:"added,omitempty"`
+	// The tracked files with the content or the mode changed.
+	Modified []string `json:"modified,omitempty"`
+	// The tracked files removed from the worktree.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+func (tr *TamperReport) empty() bool {
+	return len(tr.Added) == 0 && len(tr.Modified) == 0 && len(tr.Deleted) == 0
+}
+
+// runVerify compares the worktree of the checkout against the tree of HEAD
+// and, when configured, restores the tracked state of the changed paths.
+func (r *Repository) runVerify() (*TamperReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	repoDir := filepath.Join(expandDir(r.Config.BaseDir), r.Config.Name)
+	repo, err := r.openRepository(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var pointers map[plumbing.Hash]*lfsPointer
+	lfs := r.newLFSStore()
+	if lfs != nil {
+		if pointers, err = collectLFSPointers(tree, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// The worktree is walked instead of using the status, which skips the
+	// files matched by .gitignore, including an untracked one. Each file is
+	// compared with the tree of HEAD, because the index could have been
+	// changed too, and the LFS objects differ from their pointers in the
+	// index.
+	excluded := r.verifyExcludedDirs(repoDir)
+	report := &TamperReport{}
+	var changed []*object.File
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(repoDir, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fp == repoDir {
+			return nil
+		}
+		rel, err := filepath.Rel(repoDir, fp)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == git.GitDirName || isExcludedPath(name, excluded) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := tree.File(name)
+		switch {
+		case err == object.ErrFileNotFound:
+			report.Added = append(report.Added, name)
+			return nil
+		case err != nil:
+			return err
+		}
+		seen[name] = true
+		if !treeFileMatches(fp, f, pointers[f.Hash]) {
+			report.Modified = append(report.Modified, name)
+			changed = append(changed, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if seen[f.Name] || isExcludedPath(f.Name, excluded) {
+			return nil
+		}
+		report.Deleted = append(report.Deleted, f.Name)
+		changed = append(changed, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(report.Added)
+	sort.Strings(report.Modified)
+	sort.Strings(report.Deleted)
+
+	if report.empty() {
+		r.setVerified(nil, false)
+		r.logger.Debug("verified worktree", zap.String("repo_name", r.Config.Name))
+		return report, nil
+	}
+	tamperEvents.WithLabelValues(r.Config.Name).Inc()
+	r.logger.Warn(
+		"detected tampered worktree",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("commit", commit.Hash.String()),
+		zap.Strings("added", report.Added),
+		zap.Strings("modified", report.Modified),
+		zap.Strings("deleted", report.Deleted),
+	)
+	if !r.Config.VerifyRepair {
+		r.setVerified(report, false)
+		return report, nil
+	}
+
+	if err := repairWorktree(repoDir, report.Added, changed, pointers, lfs); err != nil {
+		return nil, err
+	}
+	// The index is reset too, in case the changes were staged.
+	if err := w.Reset(&git.ResetOptions{Commit: commit.Hash, Mode: git.MixedReset}); err != nil {
+		return nil, err
+	}
+	r.setVerified(report, true)
+	r.logger.Warn(
+		"repaired tampered worktree",
+		zap.String("repo_name", r.Config.Name),
+		zap.String("commit", commit.Hash.String()),
+	)
+	return report, nil
+}
+
+// verifyExcludedDirs returns the directories inside the worktree, which are
+// written by the Repository outside of the checkout, i.e. the previews and
+// the git directory.
+func (r *Repository) verifyExcludedDirs(repoDir string) []string {
+	var candidates []string
+	if r.Config.Preview != nil {
+		candidates = append(candidates, r.previewsDir())
+	}
+	if r.Config.GitDir != "" {
+		candidates = append(candidates, expandDir(r.Config.GitDir))
+	}
+	var dirs []string
+	for _, dir := range candidates {
+		rel, err := filepath.Rel(repoDir, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		dirs = append(dirs, filepath.ToSlash(rel))
+	}
+	return dirs
+}
+
+// isExcludedPath checks whether the path is in one of the directories.
+func isExcludedPath(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir == "." || name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// repairWorktree removes the untracked files and writes the changed files
+// from the tree.
+func repairWorktree(repoDir string, added []string, changed []*object.File, pointers map[plumbing.Hash]*lfsPointer, lfs *lfsStore) error {
+	for _, name := range added {
+		if err := os.RemoveAll(filepath.Join(repoDir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	needed := make(map[plumbing.Hash]*lfsPointer)
+	for _, f := range changed {
+		if p, exists := pointers[f.Hash]; exists {
+			needed[f.Hash] = p
+		}
+	}
+	if len(needed) > 0 {
+		if err := lfs.fetch(needed); err != nil {
+			return err
+		}
+	}
+	for _, f := range changed {
+		fp := filepath.Join(repoDir, filepath.FromSlash(f.Name))
+		if p, exists := needed[f.Hash]; exists {
+			if err := lfs.writeObject(repoDir, fp, p, treeFilePerm(f)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeTreeFile(repoDir, fp, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeFileMatches checks whether the file in the worktree has the content
+// and the type of the file in the tree. The content of LFS object is
+// compared with the pointer.
+func treeFileMatches(fp string, f *object.File, p *lfsPointer) bool {
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		return false
+	}
+	if f.Mode == filemode.Symlink {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+		target, err := os.Readlink(fp)
+		if err != nil {
+			return false
+		}
+		content, err := f.Contents()
+		return err == nil && target == content
+	}
+	if !fi.Mode().IsRegular() || (fi.Mode().Perm()&0111 != 0) != (f.Mode == filemode.Executable) {
+		return false
+	}
+	if p != nil {
+		if fi.Size() != p.Size {
+			return false
+		}
+		oid, err := computeFileOID(fp)
+		return err == nil && oid == p.OID
+	}
+	if fi.Size() != f.Size {
+		return false
+	}
+	h, err := computeFileHash(fp)
+	return err == nil && h == f.Hash
+}
+
+func verifier(r *Repository) {
+	r.logger.Debug(
+		"worktree verification enabled",
+		zap.String("repo_name", r.Config.Name),
+		zap.Int("interval", r.Config.VerifyInterval),
+		zap.Bool("repair", r.Config.VerifyRepair),
+	)
+	intervals := time.NewTicker(time.Second * time.Duration(r.Config.VerifyInterval))
+	defer intervals.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-intervals.C:
+		}
+		if _, err := r.runVerify(); err != nil {
+			r.logger.Error("failed verifying worktree", zap.String("repo_name", r.Config.Name), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepositoryVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		repair  bool
+		lfs     bool
+		want    *TamperReport
+		wantDir map[string]string
+	}{
+		{
+			name: "test tampered worktree is reported",
+			want: &TamperReport{
+				Added:    []string{"shell.php"},
+				Modified: []string{"index.html", "videos/intro.mp4"},
+				Deleted:  []string{"docs/about.html"},
+			},
+			wantDir: map[string]string{
+				"index.html":       "defaced",
+				"shell.php":        "<?php",
+				"videos/intro.mp4": "intro v2",
+			},
+		},
+		{
+			name:   "test tampered worktree is repaired",
+			repair: true,
+			want: &TamperReport{
+				Added:    []string{"shell.php"},
+				Modified: []string{"index.html", "videos/intro.mp4"},
+				Deleted:  []string{"docs/about.html"},
+			},
+			wantDir: map[string]string{
+				"index.html":       "v1",
+				"docs/about.html":  "about",
+				"videos/intro.mp4": "intro v1",
+			},
+		},
+		{
+			name:   "test tampered lfs worktree is repaired",
+			repair: true,
+			lfs:    true,
+			want: &TamperReport{
+				Added:    []string{"shell.php"},
+				Modified: []string{"index.html", "videos/intro.mp4"},
+				Deleted:  []string{"docs/about.html"},
+			},
+			wantDir: map[string]string{
+				"index.html":       "v1",
+				"docs/about.html":  "about",
+				"videos/intro.mp4": "intro v1",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := &RepositoryConfig{VerifyRepair: tc.repair}
+			video := []byte("intro v1")
+			if tc.lfs {
+				server := newTestLFSServer(t)
+				rc.LFS = &LFSConfig{URL: server.URL}
+				video = server.add(video)
+			}
+			upstream := newTestUpstream(t)
+			upstream.commit("initial commit", map[string][]byte{
+				"index.html":       []byte("v1"),
+				"docs/about.html":  []byte("about"),
+				"videos/intro.mp4": video,
+			})
+			rc.Address = upstream.bareDir
+			r := newTestRepository(t, rc)
+			if err := r.update(); err != nil {
+				t.Fatalf("failed cloning repo: %v", err)
+			}
+
+			report, err := r.runVerify()
+			if err != nil {
+				t.Fatalf("failed verifying worktree: %v", err)
+			}
+			if diff := cmp.Diff(&TamperReport{}, report); diff != "" {
+				t.Fatalf("unexpected report of clean worktree (-want +got):\n%s", diff)
+			}
+
+			repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+			for name, content := range map[string]string{
+				"index.html":       "defaced",
+				"shell.php":        "<?php",
+				"videos/intro.mp4": "intro v2",
+			} {
+				if err := os.WriteFile(filepath.Join(repoDir, name), []byte(content), 0644); err != nil {
+					t.Fatalf("failed writing %s: %v", name, err)
+				}
+			}
+			if err := os.Remove(filepath.Join(repoDir, "docs", "about.html")); err != nil {
+				t.Fatalf("failed removing file: %v", err)
+			}
+
+			report, err = r.runVerify()
+			if err != nil {
+				t.Fatalf("failed verifying worktree: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, report); diff != "" {
+				t.Fatalf("unexpected report (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.want, r.Status().Tampered); diff != "" {
+				t.Fatalf("unexpected status (-want +got):\n%s", diff)
+			}
+			for name, want := range tc.wantDir {
+				if diff := cmp.Diff(want, readTestFile(t, filepath.Join(repoDir, name))); diff != "" {
+					t.Fatalf("unexpected %s content (-want +got):\n%s", name, diff)
+				}
+			}
+			if !tc.repair {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(repoDir, "shell.php")); !os.IsNotExist(err) {
+				t.Fatalf("expected untracked file removed, got: %v", err)
+			}
+			report, err = r.runVerify()
+			if err != nil {
+				t.Fatalf("failed verifying repaired worktree: %v", err)
+			}
+			if diff := cmp.Diff(&TamperReport{}, report); diff != "" {
+				t.Fatalf("unexpected report of repaired worktree (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRepositoryVerifyPreviews(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{"index.html": []byte("v1")})
+	r := newTestRepository(t, &RepositoryConfig{
+		Address:      upstream.bareDir,
+		VerifyRepair: true,
+		Preview:      &PreviewConfig{},
+		Webhooks: []*WebhookConfig{
+			{Name: "Github", Header: "X-Hub-Signature-256", Secret: "foobar"},
+		},
+	})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+
+	// The previews are deployed inside the worktree by default.
+	fp := filepath.Join(r.previewsDir(), "pr-42", "index.html")
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		t.Fatalf("failed creating preview: %v", err)
+	}
+	if err := os.WriteFile(fp, []byte("pr"), 0644); err != nil {
+		t.Fatalf("failed writing preview: %v", err)
+	}
+	report, err := r.runVerify()
+	if err != nil {
+		t.Fatalf("failed verifying worktree: %v", err)
+	}
+	if diff := cmp.Diff(&TamperReport{}, report); diff != "" {
+		t.Fatalf("unexpected report (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("pr", readTestFile(t, fp)); diff != "" {
+		t.Fatalf("unexpected preview content (-want +got):\n%s", diff)
+	}
+}
+
+func TestRepositoryVerifyIgnoredFiles(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.commit("initial commit", map[string][]byte{
+		".gitignore": []byte("*.log\n"),
+		"index.html": []byte("v1"),
+		"sub/a.html": []byte("a"),
+	})
+	r := newTestRepository(t, &RepositoryConfig{Address: upstream.bareDir, VerifyRepair: true})
+	if err := r.update(); err != nil {
+		t.Fatalf("failed cloning repo: %v", err)
+	}
+
+	// The files are ignored by the tracked rule, and by an untracked
+	// .gitignore file ignoring everything in its directory.
+	repoDir := filepath.Join(r.Config.BaseDir, r.Config.Name)
+	for name, content := range map[string]string{
+		"evil.log":       "evil",
+		"sub/.gitignore": "*",
+		"sub/shell.php":  "<?php",
+	} {
+		if err := os.WriteFile(filepath.Join(repoDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed writing %s: %v", name, err)
+		}
+	}
+	report, err := r.runVerify()
+	if err != nil {
+		t.Fatalf("failed verifying worktree: %v", err)
+	}
+	want := &TamperReport{Added: []string{"evil.log", "sub/.gitignore", "sub/shell.php"}}
+	if diff := cmp.Diff(want, report); diff != "" {
+		t.Fatalf("unexpected report (-want +got):\n%s", diff)
+	}
+	for _, name := range want.Added {
+		if _, err := os.Stat(filepath.Join(repoDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s removed, got: %v", name, err)
+		}
+	}
+}
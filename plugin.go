@@ -63,7 +63,14 @@ func (m *Middleware) Validate() error {
 }
 
 // ServeHTTP performs git repository management tasks.
-func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.Endpoint.Action == service.ActionVars {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		for k, v := range m.Endpoint.Placeholders(r) {
+			repl.Set(k, v)
+		}
+		return next.ServeHTTP(w, r)
+	}
 	return m.Endpoint.ServeHTTP(r.Context(), w, r)
 }
 